@@ -0,0 +1,185 @@
+package goUrlShortener
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RequestIDHeader carries the ID of a request, from the client or a proxy in front, or generated by AccessLogger
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength caps the length of a request ID taken from a request, a longer one is replaced
+const maxRequestIDLength = 128
+
+// missDestination is logged as the destination of a request that did not redirect through a mapping
+const missDestination = "miss"
+
+// LogLevel orders log lines by severity, so that only the lines at or above a level are written
+type LogLevel int
+
+// define the log levels
+// * an access line is logged at LevelInfo, LevelWarn for a 4xx status, and LevelError for a 5xx status
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// logLevelNames are the names of the log levels, as written in log lines and read by ParseLogLevel
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// String returns the name of the level
+func (l LogLevel) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "unknown"
+	}
+	return logLevelNames[l]
+}
+
+// ParseLogLevel returns the level named name i.e. debug, info, warn or error
+func ParseLogLevel(name string) (LogLevel, error) {
+	for i, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, errors.Errorf("invalid log level %q, use debug, info, warn or error", name)
+}
+
+// accessEntry declares the JSON line AccessLogger writes for every request
+//  * Destination is the resolved destination of a redirect, or "miss" for any other response
+//  * Result is how the Redirector served the request, see the `result` label of the metrics
+type accessEntry struct {
+	Time        time.Time `json:"time"`
+	Level       string    `json:"level"`
+	RequestID   string    `json:"request_id"`
+	Method      string    `json:"method"`
+	Host        string    `json:"host"`
+	Path        string    `json:"path"`
+	Destination string    `json:"destination"`
+	Result      string    `json:"result,omitempty"`
+	Status      int       `json:"status"`
+	LatencyMS   float64   `json:"latency_ms"`
+}
+
+// accessEntryKey is the context key under which a request carries its accessEntry
+type accessEntryKey struct{}
+
+// accessEntryFrom returns the accessEntry of a request served through AccessLogger, nil otherwise
+func accessEntryFrom(r *http.Request) *accessEntry {
+	entry, _ := r.Context().Value(accessEntryKey{}).(*accessEntry)
+	return entry
+}
+
+// AccessLogger writes one JSON line per request to out, for the requests whose level is at or above its level
+type AccessLogger struct {
+	out   io.Writer
+	level LogLevel
+	mu    sync.Mutex // keeps concurrent lines from interleaving
+}
+
+// NewAccessLogger returns an AccessLogger writing to out the lines at or above level
+func NewAccessLogger(out io.Writer, level LogLevel) *AccessLogger {
+	return &AccessLogger{out: out, level: level}
+}
+
+// Handler wraps next, logging every request it serves
+//  * the request ID is taken from the X-Request-ID header of the request, or generated when it is missing or invalid
+//  * the request ID is passed on to next in the request header, and returned in the response header
+//  * a Redirector in next reports the destination it resolved, and its result
+func (al *AccessLogger) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID := r.Header.Get(RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+			r.Header.Set(RequestIDHeader, requestID)
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+
+		entry := &accessEntry{
+			RequestID:   requestID,
+			Method:      r.Method,
+			Host:        r.Host,
+			Path:        r.URL.Path,
+			Destination: missDestination,
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), accessEntryKey{}, entry)))
+
+		entry.Time = start.UTC()
+		entry.Status = sw.status
+		entry.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+		al.write(entry)
+	})
+}
+
+// write encodes entry as a single line, unless its level is below the logger's level
+func (al *AccessLogger) write(entry *accessEntry) {
+	level := LevelInfo
+	switch {
+	case entry.Status >= http.StatusInternalServerError:
+		level = LevelError
+	case entry.Status >= http.StatusBadRequest:
+		level = LevelWarn
+	}
+	if level < al.level {
+		return
+	}
+	entry.Level = level.String()
+	line, _ := json.Marshal(entry) // an accessEntry always encodes
+	al.mu.Lock()
+	al.out.Write(append(line, '\n'))
+	al.mu.Unlock()
+}
+
+// statusWriter records the status written through an http.ResponseWriter
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+// WriteHeader records status, then writes it
+func (sw *statusWriter) WriteHeader(status int) {
+	if !sw.wroteHeader {
+		sw.status, sw.wroteHeader = status, true
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes b, after the implicit 200 status when no status was written yet
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	sw.wroteHeader = true
+	return sw.ResponseWriter.Write(b)
+}
+
+// validRequestID accepts the request IDs that are safe to log and echo i.e. short and printable ASCII
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random 128-bit request ID, hex encoded
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id) // crypto/rand never fails on supported platforms
+	return hex.EncodeToString(id)
+}
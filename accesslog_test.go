@@ -0,0 +1,58 @@
+package goUrlShortener
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogger(t *testing.T) {
+	rd := &Redirector{
+		Store:    NewMemoryStore([]PathURL{{Path: "/docs", URL: "https://example.com/docs"}}),
+		Fallback: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { http.Error(w, "broken", http.StatusInternalServerError) }),
+	}
+	tests := []struct {
+		level     LogLevel
+		path      string
+		requestID string
+		logged    bool
+		want      accessEntry // the fields compared
+	}{
+		{LevelInfo, "/docs", "abc-123", true, accessEntry{Level: "info", RequestID: "abc-123", Destination: "https://example.com/docs", Result: resultHit, Status: http.StatusFound}},
+		{LevelInfo, "/missing", "", true, accessEntry{Level: "error", Destination: missDestination, Result: resultMiss, Status: http.StatusInternalServerError}},
+		{LevelWarn, "/docs", "", false, accessEntry{}},
+		{LevelError, "/missing", "bad id", true, accessEntry{Level: "error", Destination: missDestination, Result: resultMiss, Status: http.StatusInternalServerError}},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.requestID != "" {
+			r.Header.Set(RequestIDHeader, tt.requestID)
+		}
+		w := httptest.NewRecorder()
+		NewAccessLogger(&out, tt.level).Handler(rd).ServeHTTP(w, r)
+
+		echoed := w.Header().Get(RequestIDHeader)
+		if !validRequestID(echoed) || (tt.want.RequestID != "" && echoed != tt.want.RequestID) {
+			t.Errorf("%s at %s: the response carries request ID %q, want %q or a generated one", tt.path, tt.level, echoed, tt.want.RequestID)
+		}
+		if !tt.logged {
+			if out.Len() != 0 {
+				t.Errorf("%s at %s logged %s, want nothing", tt.path, tt.level, out.String())
+			}
+			continue
+		}
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		var got accessEntry
+		if len(lines) != 1 || json.Unmarshal([]byte(lines[0]), &got) != nil {
+			t.Fatalf("%s at %s logged %q, want one JSON line", tt.path, tt.level, out.String())
+		}
+		if got.Level != tt.want.Level || got.RequestID != echoed || got.Destination != tt.want.Destination ||
+			got.Result != tt.want.Result || got.Status != tt.want.Status || got.Path != tt.path || got.Method != http.MethodGet {
+			t.Errorf("%s at %s logged %+v, want %+v", tt.path, tt.level, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package goUrlShortener
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// define the default sizes of a ClickRecorder
+// * the buffer absorbs bursts while a batch is being written, events beyond it are dropped
+// * a batch is written once it is full, or flushInterval after its first event, whichever comes first
+const (
+	DefaultClickBuffer        = 10000
+	DefaultClickBatch         = 500
+	DefaultClickFlushInterval = time.Second
+)
+
+// ClickEvent records a single redirect
+//  * Host and Path are those of the mapping that served the redirect, so every path matched by a rule counts towards the rule
+//  * IP is anonymized i.e. the last byte of an IPv4 address, and all but the first 48 bits of an IPv6 address, are zeroed
+type ClickEvent struct {
+	Host        string    `json:"host,omitempty"`
+	Path        string    `json:"path"`
+	Time        time.Time `json:"time"`
+	Referrer    string    `json:"referrer,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	IP          string    `json:"ip,omitempty"`
+	Destination string    `json:"destination"`
+}
+
+// newClickEvent builds the ClickEvent of a request that pu redirected to dest
+func newClickEvent(r *http.Request, pu PathURL, dest string) ClickEvent {
+	return ClickEvent{
+		Host:        pu.Host,
+		Path:        pu.Path,
+		Time:        time.Now().UTC(),
+		Referrer:    r.Referer(),
+		UserAgent:   r.UserAgent(),
+		IP:          anonymizeIP(r.RemoteAddr),
+		Destination: dest,
+	}
+}
+
+// anonymizeIP strips the port from a remote address, and zeroes the part of the IP that identifies a single host
+func anonymizeIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// ClickSink persists batches of click events
+type ClickSink interface {
+	WriteClicks(events []ClickEvent) error
+}
+
+// ClickRecorder buffers click events and hands them to a ClickSink in batches, in the background
+//  * Record never blocks, so recording a click never slows a redirect down
+//  * when the buffer is full the event is dropped, and counted in Dropped
+type ClickRecorder struct {
+	sink          ClickSink
+	events        chan ClickEvent
+	batchSize     int
+	flushInterval time.Duration
+	dropped       uint64
+	failed        uint64
+	done          chan struct{}
+}
+
+// NewClickRecorder returns a ClickRecorder writing to sink, with the default sizes for any size that is zero
+//  * call Run, in its own goroutine, to start writing batches
+func NewClickRecorder(sink ClickSink, bufferSize, batchSize int, flushInterval time.Duration) *ClickRecorder {
+	if bufferSize <= 0 {
+		bufferSize = DefaultClickBuffer
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultClickBatch
+	}
+	if flushInterval <= 0 {
+		flushInterval = DefaultClickFlushInterval
+	}
+	return &ClickRecorder{
+		sink:          sink,
+		events:        make(chan ClickEvent, bufferSize),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		done:          make(chan struct{}),
+	}
+}
+
+// Record queues ev for the next batch, or drops it when the buffer is full
+func (cr *ClickRecorder) Record(ev ClickEvent) {
+	select {
+	case cr.events <- ev:
+	default:
+		atomic.AddUint64(&cr.dropped, 1)
+	}
+}
+
+// Dropped returns how many events were dropped because the buffer was full
+func (cr *ClickRecorder) Dropped() uint64 {
+	return atomic.LoadUint64(&cr.dropped)
+}
+
+// Failed returns how many events were lost because the sink failed to write their batch
+func (cr *ClickRecorder) Failed() uint64 {
+	return atomic.LoadUint64(&cr.failed)
+}
+
+// Run writes the queued events in batches until stop is closed, then writes what is left in the buffer
+//  * Done is closed once Run has returned, after that last write, so a shutdown can wait for the buffer to drain
+//  * a batch that fails to write is logged and counted in Failed, rather than retried, so a broken sink cannot grow memory
+//  * dropped events are logged along with the next batch
+func (cr *ClickRecorder) Run(stop <-chan struct{}) {
+	defer close(cr.done)
+	var loggedDrops uint64
+	batch := make([]ClickEvent, 0, cr.batchSize)
+	timer := time.NewTimer(cr.flushInterval)
+	timer.Stop()
+	for {
+		select {
+		case ev := <-cr.events:
+			if len(batch) == 0 {
+				timer.Reset(cr.flushInterval)
+			}
+			batch = append(batch, ev)
+			if len(batch) < cr.batchSize {
+				continue
+			}
+			timer.Stop()
+		case <-timer.C:
+		case <-stop:
+			for drained := false; !drained; {
+				select {
+				case ev := <-cr.events:
+					batch = append(batch, ev)
+				default:
+					drained = true
+				}
+			}
+			cr.flush(batch)
+			return
+		}
+		cr.flush(batch)
+		batch = batch[:0]
+		if dropped := cr.Dropped(); dropped != loggedDrops {
+			log.Printf("Dropped %d click events since the last batch, the buffer of %d is full", dropped-loggedDrops, cap(cr.events))
+			loggedDrops = dropped
+		}
+	}
+}
+
+// Done is closed once Run has written its last batch and returned
+func (cr *ClickRecorder) Done() <-chan struct{} {
+	return cr.done
+}
+
+// flush writes batch to the sink, if it holds any event
+func (cr *ClickRecorder) flush(batch []ClickEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := cr.sink.WriteClicks(batch); err != nil {
+		atomic.AddUint64(&cr.failed, uint64(len(batch)))
+		log.Printf("Failed to write %d click events: %v", len(batch), err)
+	}
+}
+
+// PostgresClickSink writes click events to the `clicks` table of a Postgres database
+//  * the table is expected to have `host`, `path`, `clicked_at`, `referrer`, `user_agent`, `ip` and `destination` columns
+//  * and a `txid` column defaulting to `txid_current()`, which ReadClicks reads the events back by
+//  * every batch is written with a single COPY, in its own transaction
+//  * it holds nothing but `db`, so it needs no Close, and can share the pool of the `paths` store
+type PostgresClickSink struct {
+	db *sql.DB
+}
+
+// NewPostgresClickSink returns a PostgresClickSink that writes through db
+func NewPostgresClickSink(db *sql.DB) *PostgresClickSink {
+	return &PostgresClickSink{db: db}
+}
+
+// WriteClicks writes events to the `clicks` table
+func (s *PostgresClickSink) WriteClicks(events []ClickEvent) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin writing clicks")
+	}
+	stmt, err := tx.Prepare(pq.CopyIn("clicks", "host", "path", "clicked_at", "referrer", "user_agent", "ip", "destination"))
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "failed to prepare writing clicks")
+	}
+	for _, ev := range events {
+		if _, err = stmt.Exec(ev.Host, ev.Path, ev.Time, ev.Referrer, ev.UserAgent, ev.IP, ev.Destination); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return errors.Wrap(err, "failed to write click")
+		}
+	}
+	if _, err = stmt.Exec(); err != nil { // flushes the COPY
+		stmt.Close()
+		tx.Rollback()
+		return errors.Wrap(err, "failed to write clicks")
+	}
+	if err = stmt.Close(); err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "failed to write clicks")
+	}
+	return errors.Wrap(tx.Commit(), "failed to commit clicks")
+}
+
+// FileClickSink appends click events to a local file, one JSON object per line
+//  * the file is only ever appended to, and is created when it does not exist
+type FileClickSink struct {
+	filename string
+}
+
+// NewFileClickSink returns a FileClickSink that appends to filename
+func NewFileClickSink(filename string) *FileClickSink {
+	return &FileClickSink{filename: filename}
+}
+
+// WriteClicks appends events to the file
+func (s *FileClickSink) WriteClicks(events []ClickEvent) error {
+	f, err := os.OpenFile(s.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open clicks file: %s", s.filename)
+	}
+	enc := json.NewEncoder(f)
+	for _, ev := range events {
+		if err = enc.Encode(ev); err != nil {
+			f.Close()
+			return errors.Wrapf(err, "failed to write clicks file: %s", s.filename)
+		}
+	}
+	return errors.Wrapf(f.Close(), "failed to close clicks file: %s", s.filename)
+}
+
+// ReadClicks reads at most limit events from the file, starting at the byte offset `after`
+//  * only whole lines are read, so an event still being appended is left for the next read
+//  * a line that fails to decode is logged and skipped
+//  * a file shorter than `after` was truncated or replaced since, which is an error rather than a silent stop
+func (s *FileClickSink) ReadClicks(after int64, limit int) ([]ClickEvent, int64, error) {
+	f, err := os.Open(s.filename)
+	if os.IsNotExist(err) {
+		return nil, after, nil // nothing was recorded yet
+	}
+	if err != nil {
+		return nil, after, errors.Wrapf(err, "failed to open clicks file: %s", s.filename)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, after, errors.Wrapf(err, "failed to read clicks file: %s", s.filename)
+	}
+	if info.Size() < after {
+		return nil, after, errors.Errorf("clicks file %s is shorter than the %d bytes already rolled up, it was truncated or replaced", s.filename, after)
+	}
+	if _, err = f.Seek(after, io.SeekStart); err != nil {
+		return nil, after, errors.Wrapf(err, "failed to read clicks file: %s", s.filename)
+	}
+
+	var events []ClickEvent
+	next := after
+	reader := bufio.NewReader(f)
+	for len(events) < limit {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break // a partial line, if any, is read again next time
+		}
+		if err != nil {
+			return nil, after, errors.Wrapf(err, "failed to read clicks file: %s", s.filename)
+		}
+		next += int64(len(line))
+		var ev ClickEvent
+		if err = json.Unmarshal(line, &ev); err != nil {
+			log.Printf("Skipping a malformed click event at offset %d of %s: %v", next-int64(len(line)), s.filename, err)
+			continue
+		}
+		events = append(events, ev)
+	}
+	return events, next, nil
+}
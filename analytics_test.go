@@ -0,0 +1,59 @@
+package goUrlShortener
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryClickSink keeps the events written to it, or fails every write with err
+type memoryClickSink struct {
+	mu     sync.Mutex
+	events []ClickEvent
+	err    error
+}
+
+func (s *memoryClickSink) WriteClicks(events []ClickEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.events = append(s.events, events...)
+	return nil
+}
+
+func TestClickRecorderDrops(t *testing.T) {
+	tests := []struct {
+		buffer, batch, recorded int
+		sinkErr                 error
+		written                 int
+		dropped, failed         uint64
+	}{
+		{10, 3, 5, nil, 5, 0, 0},
+		{10, 3, 10, nil, 10, 0, 0},
+		{10, 3, 25, nil, 10, 15, 0},
+		{4, 2, 6, fmt.Errorf("disk full"), 0, 2, 4},
+	}
+	for _, tt := range tests {
+		sink := &memoryClickSink{err: tt.sinkErr}
+		cr := NewClickRecorder(sink, tt.buffer, tt.batch, time.Hour)
+		for i := 0; i < tt.recorded; i++ { // before Run, so nothing leaves the buffer in between
+			cr.Record(ClickEvent{Path: fmt.Sprintf("/p%d", i)})
+		}
+		stop := make(chan struct{})
+		close(stop)
+		cr.Run(stop)
+
+		if len(sink.events) != tt.written || cr.Dropped() != tt.dropped || cr.Failed() != tt.failed {
+			t.Errorf("%d events into a buffer of %d = %d written, %d dropped, %d failed, want %d, %d, %d",
+				tt.recorded, tt.buffer, len(sink.events), cr.Dropped(), cr.Failed(), tt.written, tt.dropped, tt.failed)
+		}
+		select {
+		case <-cr.Done():
+		default:
+			t.Errorf("Done is still open after Run returned")
+		}
+	}
+}
@@ -0,0 +1,652 @@
+package goUrlShortener
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Base62Alphabet is the default alphabet of generated short codes
+const Base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// define the page sizes of `GET /api/links`
+const (
+	defaultListLimit = 50
+	maxListLimit     = 1000
+)
+
+// maxCodeAttempts caps how many codes are generated before giving up on finding an unused one
+const maxCodeAttempts = 10
+
+// aliasPattern restricts custom aliases to characters that need no escaping in a path
+var aliasPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// CodeGenerator generates random short codes of Length characters drawn from Alphabet
+type CodeGenerator struct {
+	Alphabet string
+	Length   int
+}
+
+// Generate returns a new random code
+//  * every character is drawn uniformly from Alphabet using crypto/rand
+func (g CodeGenerator) Generate() (string, error) {
+	if g.Length <= 0 || len(g.Alphabet) < 2 {
+		return "", errors.Errorf("invalid code generator: length %d, alphabet %q", g.Length, g.Alphabet)
+	}
+	max := big.NewInt(int64(len(g.Alphabet)))
+	code := make([]byte, g.Length)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to generate code")
+		}
+		code[i] = g.Alphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// createLinkRequest declares the body accepted by `POST /api/links`
+type createLinkRequest struct {
+	URL       string      `json:"url"`
+	Alias     string      `json:"alias,omitempty"`
+	Host      string      `json:"host,omitempty"`
+	Status    int         `json:"status,omitempty"`
+	Query     QueryPolicy `json:"query,omitempty"`
+	NotBefore *time.Time  `json:"not_before,omitempty"`
+	ExpiresAt *time.Time  `json:"expires_at,omitempty"`
+	Password  string      `json:"password,omitempty"`
+}
+
+// linkResponse declares a link as the links API and DebugHandler show it
+//  * the password hash never leaves the server, Protected tells whether the link has one
+type linkResponse struct {
+	PathURL
+	Protected bool `json:"protected,omitempty"`
+}
+
+// newLinkResponse returns pu without its password hash
+func newLinkResponse(pu PathURL) linkResponse {
+	protected := pu.PasswordHash != ""
+	pu.PasswordHash = ""
+	return linkResponse{PathURL: pu, Protected: protected}
+}
+
+// listLinksResponse declares the body returned by `GET /api/links`
+//  * Total is left out when the store would have to count every matching link for it, unless `total=true` asked for it
+//  * NextOffset is only set when there are more links after this page
+type listLinksResponse struct {
+	Links      []linkResponse `json:"links"`
+	Total      *int           `json:"total,omitempty"`
+	Offset     int            `json:"offset"`
+	Limit      int            `json:"limit"`
+	NextOffset *int           `json:"next_offset,omitempty"`
+}
+
+// LinksAPI serves the `/api/links` REST API over a Store
+//  * `POST /api/links` shortens a URL, under a custom alias or a generated code
+//  * `GET /api/links` lists the links a page at a time, optionally filtered
+//  * `GET`, `PUT`, `PATCH` and `DELETE` on `/api/links/{path}` read, replace, update and remove a single link
+//  * a `?host=<host>` query addresses the link scoped to that host, instead of the catch-all link
+//  * `GET /api/links/{path}?view=stats` reads the click stats of a link, once SetStats enabled them
+//  * every single link response carries an ETag, and changes to an existing link must send it back in `If-Match`
+//  * so an admin editing a link that someone else changed in the meantime gets a 412 instead of overwriting it
+//  * a store that implements ConditionalStore checks the ETag again as it writes, which also catches a change made through another instance
+type LinksAPI struct {
+	store  Store
+	codes  CodeGenerator
+	policy URLPolicy
+	stats  Rollups
+	mu     sync.Mutex // serializes the check-then-write of this instance, for the stores that are not a ConditionalStore
+}
+
+// NewLinksAPI returns a LinksAPI that writes new links to store, generating codes with codes
+//  * the destination of every link written is checked against policy, refusing a disallowed one even when policy skips them in the sources
+func NewLinksAPI(store Store, codes CodeGenerator, policy URLPolicy) *LinksAPI {
+	return &LinksAPI{store: store, codes: codes, policy: policy}
+}
+
+// SetStats enables `GET /api/links/{path}?view=stats`, reading from stats
+func (a *LinksAPI) SetStats(stats Rollups) {
+	a.stats = stats
+}
+
+// RequireToken serves next only to requests that send `Authorization: Bearer <token>`
+//  * every other request gets a 401, without reaching next
+//  * the token is compared in constant time, so its length and content do not leak through response times
+//  * an empty token lets every request through, for an admin listener that only binds a loopback address
+func RequireToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="goUrlShortener"`)
+			writeJSONError(w, http.StatusUnauthorized, errors.New("a valid admin token is required"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ServeHTTP routes the request to the matching endpoint
+//  * `/api/links/docs/intro` addresses the link whose path is `/docs/intro`
+//  * `GET /api/links/docs/intro?view=stats` reads the stats of that link, so that every path, even one ending in `/stats`, stays a link
+func (a *LinksAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/api/links" {
+		switch r.Method {
+		case http.MethodGet:
+			a.list(w, r)
+		case http.MethodPost:
+			a.create(w, r)
+		default:
+			methodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+		}
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/links")
+	if path == r.URL.Path || path == "/" {
+		writeJSONError(w, http.StatusNotFound, errors.Errorf("no such endpoint: %s", r.URL.Path))
+		return
+	}
+	host := strings.ToLower(r.URL.Query().Get("host"))
+	switch view := r.URL.Query().Get("view"); {
+	case view == "stats":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, r, http.MethodGet)
+			return
+		}
+		a.linkStats(w, r, host, path)
+		return
+	case view != "":
+		writeJSONError(w, http.StatusBadRequest, errors.Errorf("unknown view %q, use stats", view))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		a.get(w, r, host, path)
+	case http.MethodPut:
+		a.put(w, r, host, path)
+	case http.MethodPatch:
+		a.patch(w, r, host, path)
+	case http.MethodDelete:
+		a.delete(w, r, host, path)
+	default:
+		methodNotAllowed(w, r, http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete)
+	}
+}
+
+// list handles `GET /api/links`
+//  * `host` keeps the links scoped to that host, or the catch-all links when it is empty
+//  * `prefix` keeps the links whose path starts with it
+//  * `q` keeps the links whose path or url contains it
+//  * `offset` and `limit` select the page, with at most maxListLimit links per page
+//  * `total=true` counts every link the filter keeps, which a Pager otherwise skips
+//  * a store that implements Pager reads just the page, one link past it to tell whether there is a next page, any other store is listed in full
+func (a *LinksAPI) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	offset, err := queryInt(query, "offset", 0)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit, err := queryInt(query, "limit", defaultListLimit)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if limit < 1 || limit > maxListLimit {
+		writeJSONError(w, http.StatusBadRequest, errors.Errorf("limit must be between 1 and %d", maxListLimit))
+		return
+	}
+
+	count := false
+	if value := query.Get("total"); value != "" {
+		if count, err = strconv.ParseBool(value); err != nil {
+			writeJSONError(w, http.StatusBadRequest, errors.Errorf("total must be true or false"))
+			return
+		}
+	}
+
+	filter := ListFilter{Host: query.Get("host"), Prefix: query.Get("prefix"), Contains: query.Get("q")}
+	_, filter.ByHost = query["host"]
+	var links []PathURL
+	var total int
+	if pager, ok := a.store.(Pager); ok {
+		links, total, err = pager.ListPage(filter, offset, limit+1, count)
+	} else {
+		var pathUrls []PathURL
+		if pathUrls, err = a.store.List(); err == nil {
+			links, total = listPage(pathUrls, filter, offset, limit)
+		}
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	more := len(links) > limit
+	if more {
+		links = links[:limit]
+	}
+	resp := listLinksResponse{Links: make([]linkResponse, len(links)), Offset: offset, Limit: limit}
+	for i, pu := range links {
+		resp.Links[i] = newLinkResponse(pu)
+	}
+	if total >= 0 {
+		resp.Total = &total
+	}
+	if end := offset + limit; more || end < total {
+		resp.NextOffset = &end
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// get handles `GET /api/links/{path}`
+func (a *LinksAPI) get(w http.ResponseWriter, r *http.Request, host, path string) {
+	pu, ok, err := a.store.Lookup(HostKey(host, path))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, errors.Wrap(ErrNotFound, HostKey(host, path)))
+		return
+	}
+	w.Header().Set("ETag", etag(pu))
+	writeJSON(w, http.StatusOK, newLinkResponse(pu))
+}
+
+// linkStats handles `GET /api/links/{path}?view=stats`
+//  * `from` and `to` select the range, see statsRange
+//  * `top` caps the referrers and user agent families returned
+//  * `format=csv`, or an `Accept: text/csv` header, returns CSV instead of JSON
+func (a *LinksAPI) linkStats(w http.ResponseWriter, r *http.Request, host, path string) {
+	if a.stats == nil {
+		writeJSONError(w, http.StatusNotFound, errors.New("stats are not enabled, record clicks to enable them"))
+		return
+	}
+	query := r.URL.Query()
+	from, to, err := statsRange(query, time.Now())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	top, err := queryInt(query, "top", defaultStatsTop)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if top < 1 || top > maxStatsTop {
+		writeJSONError(w, http.StatusBadRequest, errors.Errorf("top must be between 1 and %d", maxStatsTop))
+		return
+	}
+
+	ls, err := a.stats.LinkStats(host, path, from, to, top)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if query.Get("format") == "csv" || strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		writeStatsCSV(w, ls)
+		return
+	}
+	writeJSON(w, http.StatusOK, ls)
+}
+
+// put handles `PUT /api/links/{path}`
+//  * replaces the whole link, creating it when it does not exist yet
+//  * the body may leave out `host` and `path`, but must not name different ones
+//  * a `password` in the body is hashed into the password hash, which is otherwise kept, since no response shows it
+func (a *LinksAPI) put(w http.ResponseWriter, r *http.Request, host, path string) {
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errors.Wrap(err, "invalid request body"))
+		return
+	}
+	a.update(w, r, host, path, func(current PathURL) (PathURL, error) {
+		var pu PathURL
+		if err := json.Unmarshal(body, &pu); err != nil {
+			return PathURL{}, errors.Wrap(err, "invalid request body")
+		}
+		pu.PasswordHash = current.PasswordHash
+		return pu, applyPassword(body, &pu)
+	})
+}
+
+// patch handles `PATCH /api/links/{path}`
+//  * only the fields present in the body are changed
+//  * a `password` in the body is hashed into the password hash, and an empty `password` removes the protection
+func (a *LinksAPI) patch(w http.ResponseWriter, r *http.Request, host, path string) {
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errors.Wrap(err, "invalid request body"))
+		return
+	}
+	a.update(w, r, host, path, func(current PathURL) (PathURL, error) {
+		if current.Path == "" {
+			return PathURL{}, ErrNotFound
+		}
+		passwordHash := current.PasswordHash
+		if err := json.Unmarshal(body, &current); err != nil { // fields missing from the body keep their current value
+			return PathURL{}, errors.Wrap(err, "invalid request body")
+		}
+		current.PasswordHash = passwordHash
+		return current, applyPassword(body, &current)
+	})
+}
+
+// applyPassword sets the PasswordHash of pu from the `password` field of body, when body has one
+//  * an empty `password` clears the PasswordHash
+//  * a `password_hash` in the body is never used, the API only takes plain passwords
+func applyPassword(body json.RawMessage, pu *PathURL) error {
+	var req struct {
+		Password *string `json:"password"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return errors.Wrap(err, "invalid request body")
+	}
+	switch {
+	case req.Password == nil:
+		return nil
+	case *req.Password == "":
+		pu.PasswordHash = ""
+		return nil
+	}
+	passwordHash, err := HashPassword(*req.Password)
+	if err != nil {
+		return err
+	}
+	pu.PasswordHash = passwordHash
+	return nil
+}
+
+// update runs the shared steps of put and patch
+//  * checks `If-Match` against the current link, which is required unless the link does not exist yet
+//  * builds the new link from the current one (the zero PathURL when it does not exist) with change
+//  * validates and stores the new link, then responds with it and its new ETag
+func (a *LinksAPI) update(w http.ResponseWriter, r *http.Request, host, path string, change func(current PathURL) (PathURL, error)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := HostKey(host, path)
+	current, exists, ok := a.checkIfMatch(w, r, key)
+	if !ok {
+		return
+	}
+	pu, err := change(current)
+	if err == ErrNotFound {
+		writeJSONError(w, http.StatusNotFound, errors.Wrap(err, key))
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if pu.Path != "" && pu.Path != path {
+		writeJSONError(w, http.StatusBadRequest, errors.Errorf("body path %q does not match %q", pu.Path, path))
+		return
+	}
+	if pu.Host != "" && !strings.EqualFold(pu.Host, host) {
+		writeJSONError(w, http.StatusBadRequest, errors.Errorf("body host %q does not match %q, use ?host= to address a host", pu.Host, host))
+		return
+	}
+	pu.Host, pu.Path = host, path
+	if isHealthPath(path) {
+		writeJSONError(w, http.StatusConflict, errors.Errorf("path is reserved: %s", path))
+		return
+	}
+	if err = CheckPathUrls([]PathURL{pu}, a.policy); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var expected *PathURL
+	if exists {
+		expected = &current
+	}
+	err = a.putIf(pu, expected)
+	if err == ErrConflict {
+		writeJSONError(w, http.StatusPreconditionFailed, errors.Errorf("%s was changed by someone else, GET it again before retrying", key))
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	status := http.StatusOK
+	if !exists {
+		status = http.StatusCreated
+	}
+	w.Header().Set("ETag", etag(pu))
+	writeJSON(w, status, newLinkResponse(pu))
+}
+
+// delete handles `DELETE /api/links/{path}`
+func (a *LinksAPI) delete(w http.ResponseWriter, r *http.Request, host, path string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := HostKey(host, path)
+	current, exists, ok := a.checkIfMatch(w, r, key)
+	if !ok {
+		return
+	}
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, errors.Wrap(ErrNotFound, key))
+		return
+	}
+	err := a.deleteIf(key, current)
+	if err == ErrConflict {
+		writeJSONError(w, http.StatusPreconditionFailed, errors.Errorf("%s was changed by someone else, GET it again before retrying", key))
+		return
+	}
+	if errors.Cause(err) == ErrNotFound { // served by a layer other than the one the store writes to
+		writeJSONError(w, http.StatusConflict, errors.Errorf("%s is not held by the writable source, remove it from its own source", key))
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// putIf stores pu while the link is still `expected`, in the same step when the store is a ConditionalStore
+func (a *LinksAPI) putIf(pu PathURL, expected *PathURL) error {
+	if conditional, ok := a.store.(ConditionalStore); ok {
+		return conditional.PutIf(pu, expected)
+	}
+	return a.store.Put(pu)
+}
+
+// deleteIf removes the link for key while it is still `expected`, in the same step when the store is a ConditionalStore
+func (a *LinksAPI) deleteIf(key string, expected PathURL) error {
+	if conditional, ok := a.store.(ConditionalStore); ok {
+		return conditional.DeleteIf(key, expected)
+	}
+	return a.store.Delete(key)
+}
+
+// checkIfMatch looks up the current link and compares its ETag with the `If-Match` header
+//  * responds 428 when the link exists but `If-Match` is missing
+//  * responds 412 when `If-Match` does not match the current link
+//  * returns ok as false when it has already responded
+func (a *LinksAPI) checkIfMatch(w http.ResponseWriter, r *http.Request, key string) (current PathURL, exists, ok bool) {
+	current, exists, err := a.store.Lookup(key)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return PathURL{}, false, false
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	switch {
+	case ifMatch == "" && exists:
+		writeJSONError(w, http.StatusPreconditionRequired, errors.Errorf("If-Match is required to change %s, GET it first for its ETag", key))
+		return PathURL{}, false, false
+	case ifMatch == "" || ifMatch == "*" && exists:
+		return current, exists, true
+	case !exists || !etagMatches(ifMatch, etag(current)):
+		if exists {
+			w.Header().Set("ETag", etag(current))
+		}
+		writeJSONError(w, http.StatusPreconditionFailed, errors.Errorf("%s was changed by someone else, GET it again before retrying", key))
+		return PathURL{}, false, false
+	}
+	return current, exists, true
+}
+
+// create handles `POST /api/links`
+//  * validates the destination URL against the URLPolicy, along with the rest of the new mapping
+//  * uses the alias as the path when one is given, rejecting it with 409 when the path is taken
+//  * otherwise generates codes until one is not taken
+//  * persists the new PathURL and responds 201 with it
+func (a *LinksAPI) create(w http.ResponseWriter, r *http.Request) {
+	var req createLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errors.Wrap(err, "invalid request body"))
+		return
+	}
+	pu := PathURL{Host: strings.ToLower(req.Host), Path: "/" + req.Alias, URL: req.URL, Status: req.Status, Query: req.Query, NotBefore: req.NotBefore, ExpiresAt: req.ExpiresAt}
+	if req.Password != "" {
+		passwordHash, err := HashPassword(req.Password)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		pu.PasswordHash = passwordHash
+	}
+	if err := CheckPathUrls([]PathURL{pu}, a.policy); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Alias != "" && !aliasPattern.MatchString(req.Alias) {
+		writeJSONError(w, http.StatusBadRequest, errors.Errorf("invalid alias %q, use letters, digits, '-' and '_' only", req.Alias))
+		return
+	}
+	if isHealthPath(pu.Path) {
+		writeJSONError(w, http.StatusConflict, errors.Errorf("alias is reserved: %s", req.Alias))
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if req.Alias != "" {
+		_, taken, err := a.store.Lookup(pu.key())
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if taken {
+			writeJSONError(w, http.StatusConflict, errors.Errorf("alias already in use: %s", req.Alias))
+			return
+		}
+	} else {
+		path, err := a.unusedPath(pu.Host)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		pu.Path = path
+	}
+
+	err := a.putIf(pu, nil)
+	if err == ErrConflict { // taken through another instance since the lookup above
+		writeJSONError(w, http.StatusConflict, errors.Errorf("path already in use: %s", pu.Path))
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	location := "/api/links" + pu.Path
+	if pu.Host != "" {
+		location += "?host=" + url.QueryEscape(pu.Host)
+	}
+	w.Header().Set("Location", location)
+	w.Header().Set("ETag", etag(pu))
+	writeJSON(w, http.StatusCreated, newLinkResponse(pu))
+}
+
+// unusedPath generates codes until it finds one whose path is not in the store for host, nor reserved
+func (a *LinksAPI) unusedPath(host string) (string, error) {
+	for i := 0; i < maxCodeAttempts; i++ {
+		code, err := a.codes.Generate()
+		if err != nil {
+			return "", err
+		}
+		_, taken, err := a.store.Lookup(HostKey(host, "/"+code))
+		if err != nil {
+			return "", err
+		}
+		if !taken && !isHealthPath("/"+code) {
+			return "/" + code, nil
+		}
+	}
+	return "", errors.Errorf("no unused code found after %d attempts, consider a longer code length", maxCodeAttempts)
+}
+
+// etag returns the strong ETag of a link i.e. a hash of its JSON encoding, leaving out its ClicksLeft
+//  * any change to any other field of the link changes its ETag
+//  * a redirect taking a click off does not, so it never fails an edit in progress
+func etag(pu PathURL) string {
+	pu.ClicksLeft = nil
+	data, _ := json.Marshal(pu) // a PathURL always encodes
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether the `If-Match` header lists tag
+func etagMatches(ifMatch, tag string) bool {
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		if strings.TrimSpace(candidate) == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// queryInt reads a non-negative integer query parameter, returning def when it is missing
+func queryInt(query url.Values, name string, def int) (int, error) {
+	value := query.Get(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("%s must be a non-negative integer", name)
+	}
+	return n, nil
+}
+
+// methodNotAllowed responds 405, listing the allowed methods in the `Allow` header
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeJSONError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+}
+
+// writeJSON encodes v as the JSON response body with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError responds with `{"error": "..."}` and the given status
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,103 @@
+package goUrlShortener
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveAPI sends one request to api, with an `If-Match` header unless ifMatch is empty
+func serveAPI(api *LinksAPI, method, target, ifMatch, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if ifMatch != "" {
+		r.Header.Set("If-Match", ifMatch)
+	}
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	return w
+}
+
+func TestCheckIfMatch(t *testing.T) {
+	clicks := 5
+	store := NewMemoryStore([]PathURL{{Path: "/docs", URL: "https://example.com/docs", ClicksLeft: &clicks}})
+	api := NewLinksAPI(store, CodeGenerator{Alphabet: Base62Alphabet, Length: 6}, URLPolicy{})
+
+	w := serveAPI(api, http.MethodGet, "/api/links/docs", "", "")
+	current := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || current == "" {
+		t.Fatalf("GET = %d with ETag %q, want 200 with an ETag", w.Code, current)
+	}
+	if _, err := store.ConsumeClick("/docs"); err != nil { // a redirect in between does not change the ETag
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, method, target, ifMatch string
+		want                          int
+	}{
+		{"missing on an existing link", http.MethodPatch, "/api/links/docs", "", http.StatusPreconditionRequired},
+		{"stale", http.MethodPatch, "/api/links/docs", `"stale"`, http.StatusPreconditionFailed},
+		{"stale on a missing link", http.MethodPut, "/api/links/new", `"stale"`, http.StatusPreconditionFailed},
+		{"missing on a new link", http.MethodPut, "/api/links/new", "", http.StatusCreated},
+		{"current", http.MethodPatch, "/api/links/docs", current, http.StatusOK},
+		{"replaced", http.MethodPatch, "/api/links/docs", current, http.StatusPreconditionFailed},
+		{"any", http.MethodPatch, "/api/links/docs", "*", http.StatusOK},
+		{"missing on a delete", http.MethodDelete, "/api/links/docs", "", http.StatusPreconditionRequired},
+	}
+	for _, tt := range tests {
+		w := serveAPI(api, tt.method, tt.target, tt.ifMatch, `{"url": "https://example.com/`+strings.Replace(tt.name, " ", "-", -1)+`"}`)
+		if w.Code != tt.want {
+			t.Errorf("%s: %s %s = %d, want %d: %s", tt.name, tt.method, tt.target, w.Code, tt.want, w.Body)
+		}
+		if w.Code == http.StatusPreconditionFailed && strings.HasSuffix(tt.target, "/docs") && w.Header().Get("ETag") == "" {
+			t.Errorf("%s: 412 without the current ETag", tt.name)
+		}
+	}
+}
+
+func TestLinksAPIList(t *testing.T) {
+	var pathUrls []PathURL
+	for i := 0; i < 5; i++ {
+		pathUrls = append(pathUrls, PathURL{Path: fmt.Sprintf("/p%d", i), URL: "https://example.com"})
+	}
+	layered := NewLayeredStore(Layer{Name: "sql", Store: memoryPager{NewMemoryStore(pathUrls)}})
+
+	tests := []struct {
+		target     string
+		links      int
+		total      *int
+		nextOffset *int
+	}{
+		{"/api/links?limit=2", 2, nil, intPtr(2)},
+		{"/api/links?limit=2&offset=3", 2, nil, nil},
+		{"/api/links?limit=2&offset=2&total=true", 2, intPtr(5), intPtr(4)},
+		{"/api/links?limit=5&total=true", 5, intPtr(5), nil},
+	}
+	for _, tt := range tests {
+		w := serveAPI(NewLinksAPI(layered, CodeGenerator{}, URLPolicy{}), http.MethodGet, tt.target, "", "")
+		var resp listLinksResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %v", tt.target, err)
+		}
+		if len(resp.Links) != tt.links || !equalIntPtr(resp.Total, tt.total) || !equalIntPtr(resp.NextOffset, tt.nextOffset) {
+			t.Errorf("%s = %d links, total %v, next offset %v, want %d, %v, %v", tt.target,
+				len(resp.Links), resp.Total, resp.NextOffset, tt.links, tt.total, tt.nextOffset)
+		}
+	}
+}
+
+// intPtr returns a pointer to n
+func intPtr(n int) *int {
+	return &n
+}
+
+// equalIntPtr reports whether a and b are both nil, or point at equal ints
+func equalIntPtr(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
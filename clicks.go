@@ -0,0 +1,176 @@
+package goUrlShortener
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// ClickConsumer is implemented by Stores that can enforce the ClicksLeft of their mappings
+//  * ConsumeClick takes one click off the mapping for key, as a single atomic step
+//  * returns ok as false, without changing anything, when the mapping has no clicks left
+//  * a mapping without a limit i.e. a nil ClicksLeft, always returns ok
+type ClickConsumer interface {
+	ConsumeClick(key string) (ok bool, err error)
+}
+
+// checkClicks rejects a negative click limit
+func checkClicks(pu PathURL) error {
+	if pu.ClicksLeft != nil && *pu.ClicksLeft < 0 {
+		return errors.Errorf("invalid clicks_left %d, use 0 or more", *pu.ClicksLeft)
+	}
+	return nil
+}
+
+// ConsumeClick takes one click off the mapping for key
+func (m *MemoryStore) ConsumeClick(key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pu, ok := m.pathsToUrls[key]
+	if !ok {
+		return false, ErrNotFound
+	}
+	if pu.ClicksLeft == nil {
+		return true, nil
+	}
+	if *pu.ClicksLeft <= 0 {
+		return false, nil
+	}
+	left := *pu.ClicksLeft - 1 // a new int, since the old one may be shared with a copy handed out by Lookup
+	pu.ClicksLeft = &left
+	m.pathsToUrls[key] = pu
+	if isPatternRule(pu.Path) {
+		m.patterns = buildPatterns(m.pathsToUrls)
+	}
+	return true, nil
+}
+
+// ConsumeClick takes one click off the mapping for key, then records it in the clicks file
+//  * so the remaining clicks survive a restart, without rewriting the mapping file on every redirect
+//  * the clicks file i.e. `<filename>.clicks`, holds the clicks used per key against the limit the mapping file gave
+func (fs *FileStore) ConsumeClick(key string) (bool, error) {
+	fs.writeMu.Lock()
+	defer fs.writeMu.Unlock()
+	ok, err := fs.MemoryStore.ConsumeClick(key)
+	if err != nil || !ok {
+		return ok, err
+	}
+	pu, _, err := fs.MemoryStore.Lookup(key)
+	if err != nil || pu.ClicksLeft == nil {
+		return true, err
+	}
+	c, counted := fs.clicks[key]
+	if !counted { // nothing used since the file was written, so it holds the limit the click was taken off
+		c.Limit = *pu.ClicksLeft + 1
+	}
+	c.Used++
+	fs.clicks[key] = c
+	return true, fs.saveClicks()
+}
+
+// clickCount is the entry of a mapping in the clicks file of a FileStore
+type clickCount struct {
+	Limit int `json:"limit"` // the clicks_left of the mapping file the clicks were counted against
+	Used  int `json:"used"`
+}
+
+// clicksFilename returns the name of the clicks file, next to the mapping file
+func (fs *FileStore) clicksFilename() string {
+	return fs.filename + ".clicks"
+}
+
+// applyClicks reads the clicks file, and takes the clicks used off the limits of pathUrls, as just parsed from the mapping file
+//  * a count against another limit than the one in the mapping file is dropped, so editing clicks_left in the file starts afresh
+//  * a missing clicks file means no clicks were used
+func (fs *FileStore) applyClicks(pathUrls []PathURL) error {
+	counts := make(map[string]clickCount)
+	data, err := ioutil.ReadFile(fs.clicksFilename())
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to read file: %s", fs.clicksFilename())
+	}
+	if err == nil {
+		if err = json.Unmarshal(data, &counts); err != nil {
+			return &ParseError{Source: fs.clicksFilename(), Err: err}
+		}
+	}
+	clicks := make(map[string]clickCount)
+	for i, pu := range pathUrls {
+		c, ok := counts[pu.key()]
+		if !ok || pu.ClicksLeft == nil || *pu.ClicksLeft != c.Limit {
+			continue
+		}
+		left := c.Limit - c.Used
+		if left < 0 {
+			left = 0
+		}
+		pathUrls[i].ClicksLeft = &left
+		clicks[pu.key()] = c
+	}
+	fs.clicks = clicks
+	return nil
+}
+
+// saveClicks writes the clicks used to the clicks file, or removes the file when none were
+func (fs *FileStore) saveClicks() error {
+	if len(fs.clicks) == 0 {
+		if err := os.Remove(fs.clicksFilename()); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "failed to remove file: %s", fs.clicksFilename())
+		}
+		return nil
+	}
+	data, err := json.Marshal(fs.clicks)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode clicks for file: %s", fs.clicksFilename())
+	}
+	return writeFileAtomic(fs.clicksFilename(), data)
+}
+
+// ConsumeClick takes one click off the mapping for key with a single conditional UPDATE
+//  * Postgres serializes concurrent updates of the row, so the clicks are shared by every server instance
+func (ps *PostgresStore) ConsumeClick(key string) (bool, error) {
+	host, path := splitHostKey(key)
+	result, err := ps.db.Exec(`update paths set clicks_left = clicks_left - 1
+		where host = $1 and path = $2 and (clicks_left is null or clicks_left > 0)`, host, path)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to consume a click of path: %s", key)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to consume a click of path: %s", key)
+	}
+	return n > 0, nil
+}
+
+// ConsumeClick takes one click off the mapping for key in Postgres, and in memory without waiting for the notification
+func (ns *NotifyStore) ConsumeClick(key string) (bool, error) {
+	ok, err := ns.db.ConsumeClick(key)
+	if err != nil || !ok {
+		return ok, err
+	}
+	if _, err = ns.MemoryStore.ConsumeClick(key); err != nil && err != ErrNotFound {
+		return true, err
+	}
+	return true, nil
+}
+
+// ConsumeClick takes one click off the mapping for key in the layer that serves it
+func (ls *LayeredStore) ConsumeClick(key string) (bool, error) {
+	_, source, ok, err := ls.Resolve(key)
+	if err != nil || !ok {
+		return false, err
+	}
+	for _, l := range ls.layers {
+		if l.Name != source {
+			continue
+		}
+		consumer, isConsumer := l.Store.(ClickConsumer)
+		if !isConsumer {
+			return false, errors.Errorf("layer %s does not support click limits", l.Name)
+		}
+		ok, err = consumer.ConsumeClick(key)
+		return ok, errors.Wrapf(err, "layer %s", l.Name)
+	}
+	return false, nil
+}
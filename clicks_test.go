@@ -0,0 +1,143 @@
+package goUrlShortener
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// concurrently runs n calls of f at once, and returns how many returned true
+func concurrently(n int, f func() bool) int {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		hits int
+	)
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if f() {
+				mu.Lock()
+				hits++
+				mu.Unlock()
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	return hits
+}
+
+func TestConsumeClickConcurrent(t *testing.T) {
+	clicks := 5
+	store := NewMemoryStore([]PathURL{{Path: "/launch", URL: "https://example.com/launch", ClicksLeft: &clicks}})
+
+	consumed := concurrently(50, func() bool {
+		ok, err := store.ConsumeClick("/launch")
+		if err != nil {
+			t.Error(err)
+		}
+		return ok
+	})
+	if consumed != clicks {
+		t.Errorf("%d concurrent clicks got through, want %d", consumed, clicks)
+	}
+	if pu, _, _ := store.Lookup("/launch"); *pu.ClicksLeft != 0 {
+		t.Errorf("ClicksLeft = %d after every click was consumed, want 0", *pu.ClicksLeft)
+	}
+	if clicks != 5 {
+		t.Errorf("ConsumeClick changed the ClicksLeft it was given, now %d", clicks)
+	}
+}
+
+func TestRedirectorSingleUseConcurrent(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "links.yaml")
+	data := []byte("- path: /once\n  url: https://example.com/once\n  clicks_left: 1\n")
+	if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewYAMLStore(filename, URLPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd := &Redirector{Store: store, Fallback: http.NotFoundHandler()}
+
+	var (
+		mu       sync.Mutex
+		statuses = make(map[int]int)
+	)
+	concurrently(20, func() bool {
+		w := httptest.NewRecorder()
+		rd.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/once", nil))
+		mu.Lock()
+		statuses[w.Code]++
+		mu.Unlock()
+		return true
+	})
+	if statuses[http.StatusFound] != 1 || statuses[http.StatusGone] != 19 {
+		t.Errorf("a single-use link answered %v, want one 302 and 19 410s", statuses)
+	}
+
+	if written, err := ioutil.ReadFile(filename); err != nil || !bytes.Equal(written, data) {
+		t.Errorf("the mapping file was rewritten by a redirect: %q, %v", written, err)
+	}
+	reloaded, err := NewYAMLStore(filename, URLPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pu, _, _ := reloaded.Lookup("/once"); pu.ClicksLeft == nil || *pu.ClicksLeft != 0 {
+		t.Errorf("the used click was not restored from the clicks file")
+	}
+}
+
+func TestFileStoreClicksFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "links.yaml")
+	write := func(clicksLeft int) {
+		data := fmt.Sprintf("# launch links\n- path: /launch\n  url: https://example.com/launch\n  clicks_left: %d\n", clicksLeft)
+		if err := ioutil.WriteFile(filename, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(3)
+	store, err := NewYAMLStore(filename, URLPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		step func() error
+		want int
+	}{
+		{"consumed", func() error { _, err := store.ConsumeClick("/launch"); return err }, 2},
+		{"restarted", func() (err error) { store, err = NewYAMLStore(filename, URLPolicy{}); return err }, 2},
+		{"consumed again", func() error { _, err := store.ConsumeClick("/launch"); return err }, 1},
+		{"limit edited in the file", func() error { write(5); return store.Load() }, 5},
+		{"consumed after the edit", func() error { _, err := store.ConsumeClick("/launch"); return err }, 4},
+		{"changed through the store", func() error {
+			return store.Put(PathURL{Path: "/other", URL: "https://example.com/other"})
+		}, 4},
+		{"restarted after the change", func() (err error) { store, err = NewYAMLStore(filename, URLPolicy{}); return err }, 4},
+	}
+	for _, tt := range tests {
+		if err := tt.step(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		pu, _, _ := store.Lookup("/launch")
+		if pu.ClicksLeft == nil || *pu.ClicksLeft != tt.want {
+			t.Errorf("%s: ClicksLeft = %v, want %d", tt.name, pu.ClicksLeft, tt.want)
+		}
+	}
+	if _, err := os.Stat(filename + ".clicks"); !os.IsNotExist(err) {
+		t.Errorf("the clicks file was kept after the mapping file was written with the clicks left: %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package goUrlShortener
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// ErrConflict is returned by a ConditionalStore when the mapping is no longer the one the change was based on
+var ErrConflict = errors.New("the mapping was changed by someone else")
+
+// ConditionalStore is implemented by Stores that can check a mapping and change it as a single step
+//  * PutIf stores pu only while the mapping for its key is still `expected`, or still missing when expected is nil
+//  * DeleteIf removes the mapping for key only while it is still `expected`
+//  * both return ErrConflict, and change nothing, when it is not
+//  * mappings are compared by their ETag, which leaves out ClicksLeft, so a click taken off in between is no conflict
+//  * and a ClicksLeft that pu leaves as in `expected` keeps the clicks taken off since
+//  * unlike a lock in the caller, this holds across every server instance sharing the store
+type ConditionalStore interface {
+	PutIf(pu PathURL, expected *PathURL) error
+	DeleteIf(key string, expected PathURL) error
+}
+
+// isExpected reports whether the current mapping, which exists or not, is still `expected`
+func isExpected(current PathURL, exists bool, expected *PathURL) bool {
+	if expected == nil {
+		return !exists
+	}
+	return exists && etag(current) == etag(*expected)
+}
+
+// sameClicks reports whether two click limits are equal, nil meaning no limit
+func sameClicks(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// PutIf stores pu only while the mapping for its key is still `expected`
+func (m *MemoryStore) PutIf(pu PathURL, expected *PathURL) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, exists := m.pathsToUrls[pu.key()]
+	if !isExpected(current, exists, expected) {
+		return ErrConflict
+	}
+	if expected != nil && sameClicks(pu.ClicksLeft, expected.ClicksLeft) {
+		pu.ClicksLeft = current.ClicksLeft
+	}
+	m.pathsToUrls[pu.key()] = pu
+	if isPatternRule(pu.Path) {
+		m.patterns = buildPatterns(m.pathsToUrls)
+	}
+	return nil
+}
+
+// DeleteIf removes the mapping for key only while it is still `expected`
+func (m *MemoryStore) DeleteIf(key string, expected PathURL) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, exists := m.pathsToUrls[key]
+	if !isExpected(current, exists, &expected) {
+		return ErrConflict
+	}
+	delete(m.pathsToUrls, key)
+	if isPatternRule(key) {
+		m.patterns = buildPatterns(m.pathsToUrls)
+	}
+	return nil
+}
+
+// PutIf stores pu only while the mapping for its key is still `expected`, then rewrites the mapping file
+func (fs *FileStore) PutIf(pu PathURL, expected *PathURL) error {
+	fs.writeMu.Lock()
+	defer fs.writeMu.Unlock()
+	if err := fs.MemoryStore.PutIf(pu, expected); err != nil {
+		return err
+	}
+	return fs.save()
+}
+
+// DeleteIf removes the mapping for key only while it is still `expected`, then rewrites the mapping file
+func (fs *FileStore) DeleteIf(key string, expected PathURL) error {
+	fs.writeMu.Lock()
+	defer fs.writeMu.Unlock()
+	if err := fs.MemoryStore.DeleteIf(key, expected); err != nil {
+		return err
+	}
+	return fs.save()
+}
+
+// sameLinkClause returns the condition that a `paths` row holds the pathArgs values of a mapping, starting at parameter $first
+//  * every column but `host` and `path`, which address the row, and `clicks_left`, which the ETag leaves out
+func sameLinkClause(first int) string {
+	return fmt.Sprintf(`url = $%d and status is not distinct from $%d and query_policy is not distinct from $%d
+		and not_before is not distinct from $%d and expires_at is not distinct from $%d and password_hash is not distinct from $%d`,
+		first, first+1, first+2, first+3, first+4, first+5)
+}
+
+// sameLinkArgs returns the values of sameLinkClause for pu
+func sameLinkArgs(pu PathURL) []interface{} {
+	args := pathArgs(pu)
+	return []interface{}{args[2], args[3], args[4], args[5], args[6], args[8]}
+}
+
+// PutIf stores pu with a single conditional INSERT or UPDATE, which Postgres serializes with every other write of the row
+func (ps *PostgresStore) PutIf(pu PathURL, expected *PathURL) error {
+	var statement string
+	args := pathArgs(pu)
+	if expected == nil {
+		statement = `insert into paths (` + pathColumns + `) values ($1, $2, $3, $4, $5, $6, $7, $8, $9) on conflict (host, path) do nothing`
+	} else {
+		statement = `update paths set url = $3, status = $4, query_policy = $5, not_before = $6, expires_at = $7, password_hash = $9,
+			clicks_left = case when $8::integer is not distinct from $10::integer then clicks_left else $8::integer end
+			where host = $1 and path = $2 and ` + sameLinkClause(11)
+		args = append(append(args, expected.ClicksLeft), sameLinkArgs(*expected)...)
+	}
+	result, err := ps.db.Exec(statement, args...)
+	if err != nil {
+		return errors.Wrapf(err, "failed to store path: %s", pu.key())
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "failed to store path: %s", pu.key())
+	}
+	if n == 0 {
+		return ErrConflict
+	}
+	if isPatternRule(pu.Path) {
+		ps.expirePatterns()
+	}
+	return nil
+}
+
+// DeleteIf removes the mapping for key with a single conditional DELETE
+func (ps *PostgresStore) DeleteIf(key string, expected PathURL) error {
+	host, path := splitHostKey(key)
+	args := append([]interface{}{host, path}, sameLinkArgs(expected)...)
+	result, err := ps.db.Exec(`delete from paths where host = $1 and path = $2 and `+sameLinkClause(3), args...)
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete path: %s", key)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete path: %s", key)
+	}
+	if n == 0 {
+		return ErrConflict
+	}
+	if isPatternRule(path) {
+		ps.expirePatterns()
+	}
+	return nil
+}
+
+// PutIf stores pu in Postgres while the row is still `expected`, then re-reads the row into memory without waiting for the notification
+func (ns *NotifyStore) PutIf(pu PathURL, expected *PathURL) error {
+	if err := ns.db.PutIf(pu, expected); err != nil {
+		return err
+	}
+	return ns.refresh(pu.Host, pu.Path)
+}
+
+// DeleteIf removes the mapping for key from Postgres while it is still `expected`, and from memory without waiting for the notification
+func (ns *NotifyStore) DeleteIf(key string, expected PathURL) error {
+	if err := ns.db.DeleteIf(key, expected); err != nil {
+		return err
+	}
+	if err := ns.MemoryStore.Delete(key); err != nil && err != ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// PutIf stores pu in the write layer while the mapping served for its key is still `expected`
+//  * a mapping served by another layer is checked here, then pu is stored unless the write layer's own mapping changes meanwhile
+//  * a write layer that is not a ConditionalStore is written with Put, after the check
+func (ls *LayeredStore) PutIf(pu PathURL, expected *PathURL) error {
+	if len(ls.layers) == 0 {
+		return errors.New("no layer to write to")
+	}
+	current, source, exists, err := ls.Resolve(pu.key())
+	if err != nil {
+		return err
+	}
+	if !isExpected(current, exists, expected) {
+		return ErrConflict
+	}
+	write := ls.layers[ls.writeLayer]
+	conditional, ok := write.Store.(ConditionalStore)
+	if !ok {
+		return write.Store.Put(pu)
+	}
+	if source != write.Name { // the write layer's own mapping, if any, is shadowed or missing
+		own, ownExists, err := write.Store.Lookup(pu.key())
+		if err != nil {
+			return errors.Wrapf(err, "layer %s", write.Name)
+		}
+		expected = nil
+		if ownExists {
+			expected = &own
+		}
+	}
+	return conditional.PutIf(pu, expected)
+}
+
+// DeleteIf removes the mapping for key from the write layer while the mapping served for it is still `expected`
+//  * returns ErrNotFound when another layer serves the key, as Delete does when the write layer holds none
+func (ls *LayeredStore) DeleteIf(key string, expected PathURL) error {
+	if len(ls.layers) == 0 {
+		return ErrNotFound
+	}
+	current, source, exists, err := ls.Resolve(key)
+	if err != nil {
+		return err
+	}
+	if !isExpected(current, exists, &expected) {
+		return ErrConflict
+	}
+	write := ls.layers[ls.writeLayer]
+	if source != write.Name {
+		return ErrNotFound
+	}
+	conditional, ok := write.Store.(ConditionalStore)
+	if !ok {
+		return write.Store.Delete(key)
+	}
+	return conditional.DeleteIf(key, expected)
+}
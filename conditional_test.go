@@ -0,0 +1,119 @@
+package goUrlShortener
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMemoryStorePutIf(t *testing.T) {
+	clicks := 3
+	read := PathURL{Path: "/promo", URL: "https://example.com/a", ClicksLeft: &clicks}
+	store := NewMemoryStore([]PathURL{read})
+	if _, err := store.ConsumeClick("/promo"); err != nil {
+		t.Fatal(err)
+	}
+
+	edit := read
+	edit.URL = "https://example.com/b"
+	if err := store.PutIf(edit, &read); err != nil {
+		t.Fatalf("PutIf after a click was taken off = %v, want no conflict", err)
+	}
+	pu, _, _ := store.Lookup("/promo")
+	if pu.URL != edit.URL || *pu.ClicksLeft != 2 {
+		t.Errorf("PutIf stored %s with %d clicks left, want %s with the 2 clicks left", pu.URL, *pu.ClicksLeft, edit.URL)
+	}
+
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"put on a stale link", store.PutIf(PathURL{Path: "/promo", URL: "https://example.com/c"}, &read)},
+		{"create on an existing link", store.PutIf(PathURL{Path: "/promo", URL: "https://example.com/c"}, nil)},
+		{"delete of a stale link", store.DeleteIf("/promo", read)},
+		{"delete of a missing link", store.DeleteIf("/missing", read)},
+	}
+	for _, tt := range tests {
+		if tt.err != ErrConflict {
+			t.Errorf("%s = %v, want ErrConflict", tt.name, tt.err)
+		}
+	}
+	if err := store.DeleteIf("/promo", pu); err != nil {
+		t.Errorf("DeleteIf of the current link = %v", err)
+	}
+}
+
+// racingStore is a Store that another instance changes right after every Lookup, before the LinksAPI writes
+type racingStore struct {
+	*MemoryStore
+}
+
+func (rs racingStore) Lookup(key string) (PathURL, bool, error) {
+	pu, ok, err := rs.MemoryStore.Lookup(key)
+	if ok {
+		changed := pu
+		changed.URL += "/changed"
+		rs.MemoryStore.Put(changed)
+	}
+	return pu, ok, err
+}
+
+func TestLinksAPIConflictAcrossInstances(t *testing.T) {
+	store := NewMemoryStore([]PathURL{{Path: "/docs", URL: "https://example.com/docs"}})
+	api := NewLinksAPI(racingStore{store}, CodeGenerator{Alphabet: Base62Alphabet, Length: 6}, URLPolicy{})
+
+	for _, method := range []string{http.MethodPatch, http.MethodDelete} {
+		current, _, _ := store.Lookup("/docs")
+		tag := etag(current) // passes checkIfMatch, then the link changes before the write
+		r := httptest.NewRequest(method, "/api/links/docs", strings.NewReader(`{"url": "https://example.com/mine"}`))
+		r.Header.Set("If-Match", tag)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		if w.Code != http.StatusPreconditionFailed {
+			t.Errorf("%s racing another instance = %d, want 412: %s", method, w.Code, w.Body)
+		}
+		if pu, _, _ := store.Lookup("/docs"); !strings.HasSuffix(pu.URL, "/changed") {
+			t.Errorf("%s overwrote the other instance's change with %s", method, pu.URL)
+		}
+	}
+}
+
+func TestPostgresStorePutIf(t *testing.T) {
+	db := testPostgres(t, pathsTable)
+	store, err := NewPostgresStore(db, URLPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	clicks := 3
+	pu := PathURL{Path: "/promo", URL: "https://example.com/a", ClicksLeft: &clicks}
+	if err = store.PutIf(pu, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.PutIf(pu, nil); err != ErrConflict {
+		t.Errorf("PutIf of an existing row = %v, want ErrConflict", err)
+	}
+	read, _, _ := store.Lookup("/promo")
+	if _, err = store.ConsumeClick("/promo"); err != nil {
+		t.Fatal(err)
+	}
+	edit := read
+	edit.URL = "https://example.com/b"
+	if err = store.PutIf(edit, &read); err != nil {
+		t.Fatalf("PutIf after a click was taken off = %v, want no conflict", err)
+	}
+	if got, _, _ := store.Lookup("/promo"); got.URL != edit.URL || *got.ClicksLeft != 2 {
+		t.Errorf("PutIf stored %s with %d clicks left, want %s with the 2 clicks left", got.URL, *got.ClicksLeft, edit.URL)
+	}
+	if err = store.PutIf(PathURL{Path: "/promo", URL: "https://example.com/c"}, &read); err != ErrConflict {
+		t.Errorf("PutIf on a stale row = %v, want ErrConflict", err)
+	}
+	if err = store.DeleteIf("/promo", read); err != ErrConflict {
+		t.Errorf("DeleteIf of a stale row = %v, want ErrConflict", err)
+	}
+	if err = store.DeleteIf("/promo", edit); err != nil {
+		t.Errorf("DeleteIf of the current row = %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package goUrlShortener
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// ParseError is returned when a mapping source, or a data source name, cannot be parsed
+//  * Source names what failed to parse e.g. the mapping file
+type ParseError struct {
+	Source string
+	Err    error
+}
+
+// Error names the source along with the cause
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("failed to parse %s: %v", e.Source, e.Err)
+}
+
+// Cause returns the underlying error, for errors.Cause
+func (e *ParseError) Cause() error { return e.Err }
+
+// Unwrap returns the underlying error, for errors.Is and errors.As
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// ConnectionError is returned when the database cannot be reached, or fails a query for another reason than its schema
+type ConnectionError struct {
+	Err error
+}
+
+// Error describes the failed connection along with the cause
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("database: %v", e.Err)
+}
+
+// Cause returns the underlying error, for errors.Cause
+func (e *ConnectionError) Cause() error { return e.Err }
+
+// Unwrap returns the underlying error, for errors.Is and errors.As
+func (e *ConnectionError) Unwrap() error { return e.Err }
+
+// SchemaError is returned when a table of the database lacks a column, or is missing, or holds a column of another type
+type SchemaError struct {
+	Table string
+	Err   error
+}
+
+// Error names the table along with the cause
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("the %s table does not match the expected schema: %v", e.Table, e.Err)
+}
+
+// Cause returns the underlying error, for errors.Cause
+func (e *SchemaError) Cause() error { return e.Err }
+
+// Unwrap returns the underlying error, for errors.Is and errors.As
+func (e *SchemaError) Unwrap() error { return e.Err }
+
+// dbError classifies an error returned by a query on table as a *SchemaError or a *ConnectionError
+//  * an undefined table or column, or a datatype mismatch, is a SchemaError
+//  * a nil error, and sql.ErrNoRows, are returned as they are
+func dbError(err error, table string) error {
+	if err == nil || err == sql.ErrNoRows {
+		return err
+	}
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code.Name() {
+		case "undefined_table", "undefined_column", "datatype_mismatch":
+			return &SchemaError{Table: table, Err: err}
+		}
+	}
+	return &ConnectionError{Err: err}
+}
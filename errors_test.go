@@ -0,0 +1,46 @@
+package goUrlShortener
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+func TestDBError(t *testing.T) {
+	if err := dbError(nil, "paths"); err != nil {
+		t.Errorf("dbError(nil) = %v, want nil", err)
+	}
+	if err := dbError(sql.ErrNoRows, "paths"); err != sql.ErrNoRows {
+		t.Errorf("dbError(sql.ErrNoRows) = %v, want sql.ErrNoRows", err)
+	}
+
+	tests := []struct {
+		err    error
+		schema bool
+	}{
+		{&pq.Error{Code: "42P01", Message: `relation "paths" does not exist`}, true},
+		{&pq.Error{Code: "42703", Message: `column "host" does not exist`}, true},
+		{&pq.Error{Code: "42804", Message: `column "status" is of type text`}, true},
+		{&pq.Error{Code: "08006", Message: "connection failure"}, false},
+		{&pq.Error{Code: "28P01", Message: "password authentication failed"}, false},
+		{errors.New("dial tcp 127.0.0.1:5432: connect: connection refused"), false},
+	}
+	for _, tt := range tests {
+		err := errors.Wrap(dbError(tt.err, "paths"), "failed to look up path")
+		var schemaErr *SchemaError
+		var connErr *ConnectionError
+		switch {
+		case tt.schema && !errors.As(err, &schemaErr):
+			t.Errorf("dbError(%v) = %v, want a *SchemaError", tt.err, err)
+		case tt.schema && schemaErr.Table != "paths":
+			t.Errorf("dbError(%v) names table %q, want paths", tt.err, schemaErr.Table)
+		case !tt.schema && !errors.As(err, &connErr):
+			t.Errorf("dbError(%v) = %v, want a *ConnectionError", tt.err, err)
+		}
+		if errors.Cause(err) != tt.err {
+			t.Errorf("dbError(%v) does not keep the cause, got %v", tt.err, errors.Cause(err))
+		}
+	}
+}
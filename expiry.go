@@ -0,0 +1,143 @@
+package goUrlShortener
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// activeAt reports whether pu is served at now i.e. now is within its NotBefore and ExpiresAt window
+//  * NotBefore is inclusive and ExpiresAt is exclusive, an unset bound is open-ended
+func (pu PathURL) activeAt(now time.Time) bool {
+	if pu.NotBefore != nil && now.Before(*pu.NotBefore) {
+		return false
+	}
+	return !pu.expiredAt(now)
+}
+
+// expiredAt reports whether pu has an ExpiresAt that is not after t
+func (pu PathURL) expiredAt(t time.Time) bool {
+	return pu.ExpiresAt != nil && !pu.ExpiresAt.After(t)
+}
+
+// checkWindow rejects a mapping whose NotBefore is not before its ExpiresAt, since it could never be served
+func checkWindow(pu PathURL) error {
+	if pu.NotBefore != nil && pu.ExpiresAt != nil && !pu.NotBefore.Before(*pu.ExpiresAt) {
+		return errors.Errorf("not_before %s must be before expires_at %s", pu.NotBefore.Format(time.RFC3339), pu.ExpiresAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// expiredLister is implemented by Stores that can list their expired mappings without listing every mapping
+type expiredLister interface {
+	expired(before time.Time) ([]PathURL, error)
+}
+
+// keysDeleter is implemented by Stores that can remove several mappings at a lower cost than one Delete each
+type keysDeleter interface {
+	deleteKeys(keys []string) error
+}
+
+// SweepExpired removes from store every mapping whose ExpiresAt is not after `before`, and returns how many it removed
+//  * archive, when not nil, receives the expired mappings before they are removed, so a failed archive removes nothing
+//  * a LayeredStore is swept layer by layer, since its Delete only reaches the write layer
+func SweepExpired(store Store, before time.Time, archive func([]PathURL) error) (int, error) {
+	if ls, ok := store.(*LayeredStore); ok {
+		removed := 0
+		for _, l := range ls.Layers() {
+			n, err := SweepExpired(l.Store, before, archive)
+			removed += n
+			if err != nil {
+				return removed, errors.Wrapf(err, "layer %s", l.Name)
+			}
+		}
+		return removed, nil
+	}
+
+	expired, err := listExpired(store, before)
+	if err != nil || len(expired) == 0 {
+		return 0, err
+	}
+	if archive != nil {
+		if err = archive(expired); err != nil {
+			return 0, errors.Wrap(err, "failed to archive expired paths")
+		}
+	}
+
+	keys := make([]string, len(expired))
+	for i, pu := range expired {
+		keys[i] = pu.key()
+	}
+	if deleter, ok := store.(keysDeleter); ok {
+		return len(keys), deleter.deleteKeys(keys)
+	}
+	for i, key := range keys {
+		if err = store.Delete(key); err != nil && errors.Cause(err) != ErrNotFound { // already removed by someone else
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// listExpired returns the mappings of store whose ExpiresAt is not after `before`
+func listExpired(store Store, before time.Time) ([]PathURL, error) {
+	if lister, ok := store.(expiredLister); ok {
+		return lister.expired(before)
+	}
+	pathUrls, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	var expired []PathURL
+	for _, pu := range pathUrls {
+		if pu.expiredAt(before) {
+			expired = append(expired, pu)
+		}
+	}
+	return expired, nil
+}
+
+// Sweep runs SweepExpired every interval, removing the mappings that expired more than `after` ago
+//  * `after` keeps an expired link answering with the expired page for a while, before it becomes an unknown path
+//  * failures are logged, and the next sweep tries again
+//  * nothing is swept on the call itself, only on every tick until stop is closed, so a restart loop cannot sweep in a burst
+func Sweep(store Store, interval, after time.Duration, archive func([]PathURL) error, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			n, err := SweepExpired(store, time.Now().Add(-after), archive)
+			if err != nil {
+				log.Printf("Failed to sweep expired paths: %v", err)
+			}
+			if n > 0 {
+				log.Printf("Swept %d expired paths", n)
+			}
+		}
+	}
+}
+
+// FileArchive returns an archive for SweepExpired that appends each mapping to filename, one JSON object per line
+//  * the file is created when it does not exist
+func FileArchive(filename string) func([]PathURL) error {
+	return func(pathUrls []PathURL) error {
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return errors.Wrapf(err, "failed to open archive: %s", filename)
+		}
+		enc := json.NewEncoder(f)
+		for _, pu := range pathUrls {
+			if err = enc.Encode(pu); err != nil {
+				f.Close()
+				return errors.Wrapf(err, "failed to write archive: %s", filename)
+			}
+		}
+		return errors.Wrapf(f.Close(), "failed to close archive: %s", filename)
+	}
+}
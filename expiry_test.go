@@ -0,0 +1,72 @@
+package goUrlShortener
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSweepExpired(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+	mappings := func() []PathURL {
+		return []PathURL{
+			{Path: "/forever", URL: "https://example.com"},
+			{Path: "/old", URL: "https://example.com", ExpiresAt: at(-48 * time.Hour)},
+			{Path: "/just-expired", URL: "https://example.com", ExpiresAt: at(0)},
+			{Path: "/later", URL: "https://example.com", ExpiresAt: at(time.Hour)},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		before   time.Time
+		archive  error
+		removed  int
+		archived int
+		left     string
+	}{
+		{"up to now", now, nil, 2, 2, "[/forever /later]"},
+		{"kept a day after expiry", now.Add(-24 * time.Hour), nil, 1, 1, "[/forever /just-expired /later]"},
+		{"nothing expired yet", now.Add(-72 * time.Hour), nil, 0, 0, "[/forever /just-expired /later /old]"},
+		{"failed archive", now, fmt.Errorf("disk full"), 0, 0, "[/forever /just-expired /later /old]"},
+	}
+	for _, tt := range tests {
+		filename := filepath.Join(t.TempDir(), "links.yaml")
+		data, _ := marshalYAML(mappings())
+		if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		file, err := NewYAMLStore(filename, URLPolicy{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		inline := NewMemoryStore(mappings())
+		for _, store := range []Store{inline, NewLayeredStore(Layer{Name: "yaml", Store: file})} {
+			archived := 0
+			removed, err := SweepExpired(store, tt.before, func(expired []PathURL) error {
+				archived += len(expired)
+				return tt.archive
+			})
+			if (err != nil) != (tt.archive != nil) || removed != tt.removed {
+				t.Errorf("%s: SweepExpired of %T = %d, %v, want %d removed", tt.name, store, removed, err, tt.removed)
+			}
+			if tt.archive == nil && archived != tt.archived {
+				t.Errorf("%s: archived %d mappings, want %d", tt.name, archived, tt.archived)
+			}
+			pathUrls, _ := store.List()
+			var left []string
+			for _, pu := range pathUrls {
+				left = append(left, pu.Path)
+			}
+			if fmt.Sprint(left) != tt.left {
+				t.Errorf("%s: %T kept %v, want %s", tt.name, store, left, tt.left)
+			}
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package goUrlShortener
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// FileStore is a Store backed by a YAML or JSON mapping file
+//  * mappings are served from memory
+//  * every Put or Delete rewrites the whole file, so comments in the original file are not preserved
+//  * redirects leave the file alone, the clicks they use are kept in a separate clicks file (see ConsumeClick)
+//  * Load and Watch pick up edits made to the file while the server is running
+//  * it also implements ReloadReporter, for the readiness check
+type FileStore struct {
+	*MemoryStore
+	reloadStatus
+	filename string
+	policy   URLPolicy
+	parse    func([]byte, URLPolicy) ([]PathURL, error)
+	decode   func([]byte) ([]PathURL, []int, error)
+	marshal  func([]PathURL) ([]byte, error)
+	writeMu  sync.Mutex            // serializes loads and writes of `filename`
+	modTime  time.Time             // modification time of the file when it was last loaded
+	sum      []byte                // sha256 of the file content when it was last loaded
+	parsed   bool                  // whether the content of sum parsed, so that an unchanged file is only healthy when it did
+	clicks   map[string]clickCount // clicks used per key since the mapping file was last written, as in the clicks file
+}
+
+// NewYAMLStore returns a FileStore that reads and writes the YAML file at filename, checking its urls against policy
+func NewYAMLStore(filename string, policy URLPolicy) (*FileStore, error) {
+	return newFileStore(filename, policy, parseYAML, decodeYAML, marshalYAML)
+}
+
+// NewJSONStore returns a FileStore that reads and writes the JSON file at filename, checking its urls against policy
+func NewJSONStore(filename string, policy URLPolicy) (*FileStore, error) {
+	return newFileStore(filename, policy, parseJSON, decodeJSON, marshalJSON)
+}
+
+// newFileStore loads filename once, using parse with policy, before returning the FileStore
+//  * decode is only used by Locate, to read the file as written
+func newFileStore(filename string, policy URLPolicy, parse func([]byte, URLPolicy) ([]PathURL, error), decode func([]byte) ([]PathURL, []int, error), marshal func([]PathURL) ([]byte, error)) (*FileStore, error) {
+	fs := &FileStore{
+		MemoryStore: NewMemoryStore(nil),
+		filename:    filename,
+		policy:      policy,
+		parse:       parse,
+		decode:      decode,
+		marshal:     marshal,
+		clicks:      make(map[string]clickCount),
+	}
+	if err := fs.Load(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// Filename returns the path of the mapping file behind the store
+func (fs *FileStore) Filename() string {
+	return fs.filename
+}
+
+// Locate reads the mapping file as written, naming the line each mapping starts on
+//  * unlike Load, mappings that fail their checks are returned too
+func (fs *FileStore) Locate() ([]SourceMapping, error) {
+	data, err := ioutil.ReadFile(fs.filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read file: %s", fs.filename)
+	}
+	pathUrls, lines, err := fs.decode(data)
+	if err != nil {
+		return nil, &ParseError{Source: fs.filename, Err: err}
+	}
+	mappings := make([]SourceMapping, len(pathUrls))
+	for i, pu := range pathUrls {
+		mappings[i] = SourceMapping{PathURL: pu, Location: fmt.Sprintf("%s line %d", fs.filename, lines[i])}
+	}
+	return mappings, nil
+}
+
+// Load re-reads the mapping file and replaces the in-memory mappings with its content
+//  * a file that fails to read or parse leaves the last good mappings in place
+func (fs *FileStore) Load() error {
+	_, err := fs.reload(true)
+	return err
+}
+
+// Watch polls the mapping file every interval and reloads it when it has changed
+//  * a change is spotted by the modification time, then confirmed by the content hash
+//  * a file that fails to read or parse keeps the last good mappings, and the error is logged
+//  * the first poll is one interval after the call, since newFileStore has just loaded the file, and polling goes on until stop is closed
+func (fs *FileStore) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			changed, err := fs.reload(false)
+			if err != nil {
+				log.Printf("Keeping the last good mappings for %s: %v", fs.filename, err)
+				continue
+			}
+			if changed {
+				log.Printf("Reloaded the mappings from %s", fs.filename)
+			}
+		}
+	}
+}
+
+// reload reads and parses the mapping file, then swaps the parsed mappings into the MemoryStore
+//  * unless force is set, the file is only re-read when its modification time moved
+//  * and only re-parsed when its content hash differs from the last load
+//  * the clicks file is read along with every parse, so the mappings come back with the clicks they have left
+//  * returns true when the mappings were replaced, or a *ParseError when the file holds an invalid mapping or does not parse
+//  * every replacement and every failure is counted in the reload metrics, and reported to the readiness check
+//  * a file read back unchanged since its last good load clears a failure reported in between e.g. while it was missing
+func (fs *FileStore) reload(force bool) (changed bool, err error) {
+	var current bool
+	defer func() {
+		countReload(fs.filename, changed, err)
+		fs.record(changed, current, err)
+	}()
+	fs.writeMu.Lock()
+	defer fs.writeMu.Unlock()
+
+	info, err := os.Stat(fs.filename)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read file: %s", fs.filename)
+	}
+	if !force && info.ModTime().Equal(fs.modTime) {
+		current = fs.parsed
+		return false, nil
+	}
+	data, err := ioutil.ReadFile(fs.filename)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read file: %s", fs.filename)
+	}
+	sum := sha256.Sum256(data)
+	if !force && bytes.Equal(sum[:], fs.sum) {
+		fs.modTime = info.ModTime() // touched but unchanged, so skip the parse next time around
+		current = fs.parsed
+		return false, nil
+	}
+	fs.modTime, fs.sum = info.ModTime(), sum[:] // remembered even when parsing fails, so a broken file is reported once
+	pathUrls, err := fs.parse(data, fs.policy)
+	if err != nil {
+		fs.parsed = false
+		return false, &ParseError{Source: fs.filename, Err: err}
+	}
+	err = fs.applyClicks(pathUrls)
+	fs.parsed = err == nil
+	if err != nil {
+		return false, err
+	}
+	fs.MemoryStore.Replace(pathUrls)
+	return true, nil
+}
+
+// Put creates or replaces the mapping for pu.Path, then rewrites the mapping file
+func (fs *FileStore) Put(pu PathURL) error {
+	fs.writeMu.Lock()
+	defer fs.writeMu.Unlock()
+	if err := fs.MemoryStore.Put(pu); err != nil {
+		return err
+	}
+	return fs.save()
+}
+
+// Delete removes the mapping for path, then rewrites the mapping file
+func (fs *FileStore) Delete(path string) error {
+	fs.writeMu.Lock()
+	defer fs.writeMu.Unlock()
+	if err := fs.MemoryStore.Delete(path); err != nil {
+		return err
+	}
+	return fs.save()
+}
+
+// deleteKeys removes the mappings for keys, then rewrites the mapping file once
+//  * keys without a mapping are skipped
+func (fs *FileStore) deleteKeys(keys []string) error {
+	fs.writeMu.Lock()
+	defer fs.writeMu.Unlock()
+	for _, key := range keys {
+		if err := fs.MemoryStore.Delete(key); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return fs.save()
+}
+
+// save writes the current mappings to the mapping file, then empties the clicks file
+//  * the mappings are written with the clicks they have left, which become their new limits
+func (fs *FileStore) save() error {
+	pathUrls, err := fs.MemoryStore.List()
+	if err != nil {
+		return err
+	}
+	data, err := fs.marshal(pathUrls)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode mappings for file: %s", fs.filename)
+	}
+	if err = writeFileAtomic(fs.filename, data); err != nil {
+		return err
+	}
+	fs.clicks = make(map[string]clickCount)
+	return fs.saveClicks()
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over filename
+//  * the rename means readers of the file never observe a half-written file
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create temporary file for: %s", filename)
+	}
+	defer os.Remove(tmp.Name()) // no-op once the rename below succeeds
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "failed to write file: %s", tmp.Name())
+	}
+	if err = tmp.Close(); err != nil {
+		return errors.Wrapf(err, "failed to close file: %s", tmp.Name())
+	}
+	return errors.Wrapf(os.Rename(tmp.Name(), filename), "failed to replace file: %s", filename)
+}
+
+// marshalYAML uses the `yaml` package to encode the mappings in the same layout parseYAML reads
+func marshalYAML(pathUrls []PathURL) ([]byte, error) {
+	return yaml.Marshal(pathUrls)
+}
+
+// marshalJSON uses the `json` package to encode the mappings in the same layout parseJSON reads
+func marshalJSON(pathUrls []PathURL) ([]byte, error) {
+	return json.MarshalIndent(pathUrls, "", "  ")
+}
@@ -0,0 +1,100 @@
+package goUrlShortener
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStoreReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "links.yaml")
+	mtime := time.Now().Add(-time.Hour)
+	write := func(url string) func() error {
+		return func() error {
+			mtime = mtime.Add(time.Second) // every write moves the modification time, however fast the steps run
+			if err := ioutil.WriteFile(filename, []byte("- path: /promo\n  url: "+url+"\n"), 0600); err != nil {
+				return err
+			}
+			return os.Chtimes(filename, mtime, mtime)
+		}
+	}
+	if err := write("https://example.com/a")(); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewYAMLStore(filename, URLPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name    string
+		change  func() error
+		force   bool
+		changed bool
+		failing bool
+		url     string
+	}{
+		{"untouched", func() error { return nil }, false, false, false, "https://example.com/a"},
+		{"untouched but forced", func() error { return nil }, true, true, false, "https://example.com/a"},
+		{"rewritten with the same content", write("https://example.com/a"), false, false, false, "https://example.com/a"},
+		{"edited", write("https://example.com/b"), false, true, false, "https://example.com/b"},
+		{"edited to an invalid url", write("ftp://example.com/c"), false, false, true, "https://example.com/b"},
+		{"edited back to a valid url", write("https://example.com/d"), false, true, false, "https://example.com/d"},
+	}
+	for _, step := range steps {
+		if err := step.change(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		changed, err := fs.reload(step.force)
+		if changed != step.changed || (err != nil) != step.failing {
+			t.Errorf("%s: reload = %v, %v, want changed %v and failing %v", step.name, changed, err, step.changed, step.failing)
+		}
+		if pu, _, _ := fs.Lookup("/promo"); pu.URL != step.url {
+			t.Errorf("%s: serves %s, want %s", step.name, pu.URL, step.url)
+		}
+	}
+}
+
+func TestFileStoreReloadRecovers(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "links.yaml")
+	good := []byte("- path: /promo\n  url: https://example.com/promo\n")
+	if err := ioutil.WriteFile(filename, good, 0600); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewYAMLStore(filename, URLPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name    string
+		change  func() error
+		failing bool
+	}{
+		{"unchanged", func() error { return nil }, false},
+		{"moved away", func() error { return os.Rename(filename, filename+".bak") }, true},
+		{"still missing", func() error { return nil }, true},
+		{"moved back unchanged", func() error { return os.Rename(filename+".bak", filename) }, false},
+		{"removed", func() error { return os.Remove(filename) }, true},
+		{"recreated unchanged", func() error { return ioutil.WriteFile(filename, good, 0600) }, false},
+		{"broken", func() error { return ioutil.WriteFile(filename, []byte("- path: [\n"), 0600) }, true},
+		{"still broken", func() error { return nil }, true},
+		{"touched but still broken", func() error { return ioutil.WriteFile(filename, []byte("- path: [\n"), 0600) }, true},
+		{"fixed", func() error { return ioutil.WriteFile(filename, good, 0600) }, false},
+	}
+	for _, step := range steps {
+		if err := step.change(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		fs.reload(false)
+		if _, err := fs.LastReload(); (err != nil) != step.failing {
+			t.Errorf("%s: LastReload error = %v, want failing %v", step.name, err, step.failing)
+		}
+	}
+	if _, ok, _ := fs.Lookup("/promo"); !ok {
+		t.Errorf("the last good mappings were not kept")
+	}
+}
@@ -1,124 +1,393 @@
 package goUrlShortener
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/pkg/errors"
 	yaml "gopkg.in/yaml.v3"
 )
 
+// redirectStatuses lists the HTTP status codes a mapping may redirect with
+//  * 301 and 308 are permanent, so crawlers pass link equity on to the destination
+//  * 307 and 308 make the client repeat the request with the same method and body e.g. for a POST endpoint
+var redirectStatuses = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusSeeOther:          true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
 // MapHandler will return an http.HandlerFunc (which also implements http.Handler)
-// * extract path in the request
-// * find keys [in the map] that match the extracted path
-// * redirect to the map value [for that key], if the key exists in the map
-// * otherwise call the fallback http.Handler
+// * copy the map into a MemoryStore
+// * then re-use the StoreHandler
 func MapHandler(pathsToUrls map[string]string, fallback http.Handler) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		path := r.URL.Path
-		dest, ok := pathsToUrls[path]
-		if ok { // `ok` would be true if `path` exists in pathsToUrls
-			http.Redirect(w, r, dest, http.StatusFound)
-			return
+	pathUrls := make([]PathURL, 0, len(pathsToUrls))
+	for path, url := range pathsToUrls {
+		pathUrls = append(pathUrls, PathURL{Path: path, URL: url})
+	}
+	return StoreHandler(NewMemoryStore(pathUrls), fallback)
+}
+
+// StoreHandler will return an http.HandlerFunc (which also implements http.Handler)
+// * wrap the store and the fallback in a Redirector with the default settings
+func StoreHandler(store Store, fallback http.Handler) http.HandlerFunc {
+	return (&Redirector{Store: store, Fallback: fallback}).ServeHTTP
+}
+
+// Redirector is the http.Handler that serves the mappings of a Store
+//  * Fallback serves every path that is not in the Store
+//  * HostFallbacks optionally replaces Fallback for requests to a given (lowercase) host
+//  * DefaultStatus is the redirect status of mappings that do not set their own, http.StatusFound when zero
+//  * DefaultQuery is the query policy of mappings that do not set their own, QueryDrop when empty
+//  * Expired serves the paths whose mapping is outside its NotBefore and ExpiresAt window, a plain 410 Gone when nil
+//  * Exhausted serves the paths whose mapping has no clicks left, a plain 410 Gone when nil
+//  * CookieKey signs the cookie that lets a visitor through a password-protected mapping, a random key per Redirector when empty
+//  * CookieTTL is how long that cookie lasts, DefaultPasswordCookieTTL when zero
+//  * Clicks optionally records a ClickEvent for every redirect
+type Redirector struct {
+	Store         Store
+	Fallback      http.Handler
+	HostFallbacks map[string]http.Handler
+	DefaultStatus int
+	DefaultQuery  QueryPolicy
+	Expired       http.Handler
+	Exhausted     http.Handler
+	CookieKey     []byte
+	CookieTTL     time.Duration
+	Clicks        *ClickRecorder
+
+	gateOnce sync.Once
+	gate     *passwordGate
+}
+
+// ServeHTTP
+// * extract host and path in the request
+// * match the extracted host and path against the store i.e. the mappings of the host, then the catch-all mappings
+// * serve the expired page, if the matched mapping is not yet, or no longer, active
+// * ask for the password of a protected mapping, unless the visitor already entered it
+// * carry the incoming query over to the destination, following the query policy
+// * take one click off a click-limited mapping, serving the exhausted page when it has none left
+// * redirect to the matched destination, if the path matches a mapping in the store, and record the click
+// * otherwise call the fallback http.Handler of the host, or the default fallback
+// * count the request by its result, and record how long it took
+// * report the result to the AccessLogger, when the request is served through one
+func (rd *Redirector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	result := rd.serve(w, r)
+	observeRequest(result, start)
+	if entry := accessEntryFrom(r); entry != nil {
+		entry.Result = result
+	}
+}
+
+// serve runs the steps of ServeHTTP, and returns the result the request is counted under
+func (rd *Redirector) serve(w http.ResponseWriter, r *http.Request) string {
+	host, path := requestHost(r), r.URL.Path
+	pu, dest, ok, err := Match(rd.Store, host, path)
+	if err != nil {
+		log.Printf("Failed to look up path %s: %v", path, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return resultError
+	}
+	if ok && !pu.activeAt(time.Now()) {
+		serveGone(w, r, rd.Expired)
+		return resultExpired
+	}
+	if ok && pu.PasswordHash != "" && !rd.passwordGate().allow(w, r, pu) {
+		return resultPassword
+	}
+	if ok { // `ok` would be true if `path` matches a mapping in the store
+		dest, err = applyQueryPolicy(dest, r.URL.RawQuery, rd.queryPolicy(pu))
+		if err != nil {
+			log.Printf("Failed to build the destination for path %s: %v", path, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return resultError
+		}
+		if pu.ClicksLeft != nil {
+			if ok, err = rd.consumeClick(pu); err != nil {
+				log.Printf("Failed to count the click on path %s: %v", path, err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return resultError
+			}
+			if !ok {
+				serveGone(w, r, rd.Exhausted)
+				return resultExhausted
+			}
 		}
+		status := rd.status(pu)
+		if pu.PasswordHash != "" && r.Method == http.MethodPost {
+			status = http.StatusSeeOther // never let a 307 or 308 re-send the password form to the destination
+		}
+		http.Redirect(w, r, dest, status)
+		if rd.Clicks != nil {
+			rd.Clicks.Record(newClickEvent(r, pu, dest))
+		}
+		if entry := accessEntryFrom(r); entry != nil {
+			entry.Destination = dest
+		}
+		return resultHit
+	}
+	if fallback, ok := rd.HostFallbacks[host]; ok {
 		fallback.ServeHTTP(w, r)
+		return resultMiss
+	}
+	rd.Fallback.ServeHTTP(w, r)
+	return resultMiss
+}
+
+// passwordGate returns the passwordGate of the Redirector, creating it on first use
+func (rd *Redirector) passwordGate() *passwordGate {
+	rd.gateOnce.Do(func() { rd.gate = newPasswordGate(rd.CookieKey, rd.CookieTTL) })
+	return rd.gate
+}
+
+// consumeClick takes one click off pu in the Store, which must implement ClickConsumer to serve click-limited mappings
+func (rd *Redirector) consumeClick(pu PathURL) (bool, error) {
+	consumer, ok := rd.Store.(ClickConsumer)
+	if !ok {
+		return false, errors.New("the store does not support click limits")
+	}
+	return consumer.ConsumeClick(pu.key())
+}
+
+// serveGone serves a path whose mapping can no longer redirect, with handler or a plain 410 Gone when it is nil
+func serveGone(w http.ResponseWriter, r *http.Request, handler http.Handler) {
+	if handler != nil {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusGone), http.StatusGone)
+}
+
+// status returns the redirect status for pu i.e. its own Status, else the DefaultStatus, else http.StatusFound
+func (rd *Redirector) status(pu PathURL) int {
+	switch {
+	case pu.Status != 0:
+		return pu.Status
+	case rd.DefaultStatus != 0:
+		return rd.DefaultStatus
+	}
+	return http.StatusFound
+}
+
+// queryPolicy returns the query policy for pu i.e. its own Query, else the DefaultQuery, else QueryDrop
+func (rd *Redirector) queryPolicy(pu PathURL) QueryPolicy {
+	switch {
+	case pu.Query != "":
+		return pu.Query
+	case rd.DefaultQuery != "":
+		return rd.DefaultQuery
 	}
+	return QueryDrop
 }
 
 // YAMLHandler will parse the provided YAML and then return an http.HandlerFunc (which also implements http.Handler)
 //  * parse the YAML file
-//  * convert parsedYAML into a map
-//  * then re-use the MapHandler
+//  * reject the file when any url breaks the zero URLPolicy i.e. any scheme but http and https, since there is no policy to skip by
+//  * load parsedYAML into a MemoryStore
+//  * then re-use the StoreHandler
+//  * for a domain allow or deny list, use NewYAMLStore with a URLPolicy behind a Redirector instead
 
 // YAMLHandler parses the YAML file [in byte form]
 func YAMLHandler(yamlBytes []byte, fallback http.Handler) (http.HandlerFunc, error) {
 	// parse the YAML file
-	pathUrls, err := parseYAML(yamlBytes)
+	pathUrls, err := parseYAML(yamlBytes, URLPolicy{})
 	if err != nil {
-		return nil, err
+		return nil, &ParseError{Source: "yaml", Err: err}
 	}
 
-	// convert parsedYAML into a map
-	pathsToUrls := buildPathsMap(pathUrls)
-
-	// re-use the MapHandler
-	// * now return the newly padded pathsToUrls
+	// re-use the StoreHandler
+	// * the mappings are fixed from here on, since the YAML bytes are not a file that could change
 	// * while returning it in a format that makes it look like you were calling MapHandler in the first place
-	return MapHandler(pathsToUrls, fallback), nil
+	return StoreHandler(NewMemoryStore(pathUrls), fallback), nil
 }
 
 // JSONHandler will parse the provided JSON and then return an http.HandlerFunc (which also implements http.Handler)
 //  * parse the JSON file
-//  * convert parsedJSON into a map
-//  * then re-use the MapHandler
+//  * reject the file when any url breaks the zero URLPolicy, as YAMLHandler does
+//  * load parsedJSON into a MemoryStore
+//  * then re-use the StoreHandler
+//  * NewJSONStore is the one that takes a URLPolicy
 
 // JSONHandler parses the JSON file [in byte form]
 func JSONHandler(jsonBytes []byte, fallback http.Handler) (http.HandlerFunc, error) {
 	// parse the JSON file
-	pathUrls, err := parseJSON(jsonBytes)
+	pathUrls, err := parseJSON(jsonBytes, URLPolicy{})
 	if err != nil {
-		return nil, err
+		return nil, &ParseError{Source: "json", Err: err}
 	}
 
-	// convert parsedJSON into a map
-	pathsToUrls := buildPathsMap(pathUrls)
-
-	// re-use the MapHandler
-	// * now return the newly padded pathsToUrls
+	// re-use the StoreHandler
+	// * the JSON mappings then redirect exactly like the YAML ones
 	// * while returning it in a format that makes it look like you were calling MapHandler in the first place
-	return MapHandler(pathsToUrls, fallback), nil
+	return StoreHandler(NewMemoryStore(pathUrls), fallback), nil
 }
 
 // SQLHandler return an http.HandlerFunc (which also implements http.Handler)
-//  * accept the incoming slice of struct data from dbQuery() in main.go
-//  * convert parsed SQL data into a map using buildPathsMap()
-//  * then re-use the MapHandler
+//  * accept the incoming slice of struct data already read from a database
+//  * reject the data when any mapping is invalid, checking the urls against the zero URLPolicy, as YAMLHandler does
+//  * NewPostgresStore is the one that takes a URLPolicy, and reads the table per request
+//  * load parsed SQL data into a MemoryStore
+//  * then re-use the StoreHandler
 
 // SQLHandler parses the sql file [in byte form]
 func SQLHandler(pathUrls []PathURL, fallback http.Handler) (http.HandlerFunc, error) {
-	// convert pathUrls into a map
-	pathsToUrls := buildPathsMap(pathUrls)
+	pathUrls, err := FilterPathUrls(pathUrls, URLPolicy{}, func(i int) string { return fmt.Sprintf("row %d", i+1) })
+	if err != nil {
+		return nil, err
+	}
 
-	// re-use the MapHandler
-	// * now return the newly padded pathsToUrls
+	// re-use the StoreHandler
+	// * the rows are served from memory, so later changes to the table are not seen
 	// * while returning it in a format that makes it look like you were calling MapHandler in the first place
-	return MapHandler(pathsToUrls, fallback), nil
+	return StoreHandler(NewMemoryStore(pathUrls), fallback), nil
 }
 
 // PathURL declares the type structure we'll parse the YAML or JSON or SQL data into
+//  * Host optionally scopes the mapping to requests for that host, empty means every host
+//  * Status is the optional redirect status, zero means the server-wide default
+//  * Query is the optional query policy, empty means the server-wide default
+//  * NotBefore and ExpiresAt optionally limit when the mapping redirects, outside that window the expired page is served
+//  * ClicksLeft optionally limits how many more times the mapping redirects, nil means no limit and 1 a single-use link
+//  * PasswordHash optionally protects the mapping with a password, as made by HashPassword, never the password itself
 type PathURL struct {
-	Path string `format:"path"`
-	URL  string `format:"url"`
+	Host         string      `format:"host" yaml:"host,omitempty" json:"host,omitempty"`
+	Path         string      `format:"path" yaml:"path" json:"path"`
+	URL          string      `format:"url" yaml:"url" json:"url"`
+	Status       int         `format:"status" yaml:"status,omitempty" json:"status,omitempty"`
+	Query        QueryPolicy `format:"query" yaml:"query,omitempty" json:"query,omitempty"`
+	NotBefore    *time.Time  `format:"not_before" yaml:"not_before,omitempty" json:"not_before,omitempty"`
+	ExpiresAt    *time.Time  `format:"expires_at" yaml:"expires_at,omitempty" json:"expires_at,omitempty"`
+	ClicksLeft   *int        `format:"clicks_left" yaml:"clicks_left,omitempty" json:"clicks_left,omitempty"`
+	PasswordHash string      `format:"password_hash" yaml:"password_hash,omitempty" json:"password_hash,omitempty"`
+}
+
+// CheckStatus rejects status codes that cannot be used to redirect, zero is accepted as "use the default"
+func CheckStatus(status int) error {
+	if status != 0 && !redirectStatuses[status] {
+		return errors.Errorf("invalid redirect status %d, use 301, 302, 303, 307 or 308", status)
+	}
+	return nil
+}
+
+// CheckPathUrls rejects parsed mappings with an invalid Host, URL, Status, Query, window, click limit, password hash or rule, naming the offending path
+//  * the URLs are checked against policy
+func CheckPathUrls(pathUrls []PathURL, policy URLPolicy) error {
+	for _, pu := range pathUrls {
+		if err := checkPathURL(pu, policy); err != nil {
+			return errors.Wrapf(err, "path %s", pu.key())
+		}
+	}
+	return nil
+}
+
+// checkPathURL rejects a single mapping with an invalid Host, URL, Status, Query, window, click limit, password hash or rule
+//  * the URL is checked against policy
+func checkPathURL(pu PathURL, policy URLPolicy) error {
+	if pu.Host != "" {
+		if err := checkHost(pu.Host); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(pu.Path, "/") {
+			return errors.New("the path of a mapping with a host must start with `/`")
+		}
+	}
+	if err := checkURLTemplate(pu.URL, policy); err != nil {
+		return err
+	}
+	if err := CheckStatus(pu.Status); err != nil {
+		return err
+	}
+	if err := CheckQueryPolicy(pu.Query); err != nil {
+		return err
+	}
+	if err := checkWindow(pu); err != nil {
+		return err
+	}
+	if err := checkClicks(pu); err != nil {
+		return err
+	}
+	if err := checkPasswordHash(pu); err != nil {
+		return err
+	}
+	return checkRule(pu)
 }
 
 // buildPathsMap converts parsedYAML into a map i.e.
 // * make empty map
 // * fill up the empty map one at a time
 // * using the data already parsed into `pathUrls`
-// * i.e. for each `Path` there is a corresponding `URL`
-func buildPathsMap(pTUrl []PathURL) map[string]string {
-	pTUrls := make(map[string]string)
+// * i.e. for each `Host` and `Path` key there is a corresponding `PathURL`
+func buildPathsMap(pTUrl []PathURL) map[string]PathURL {
+	pTUrls := make(map[string]PathURL)
 	for _, pu := range pTUrl {
-		pTUrls[pu.Path] = pu.URL
+		pTUrls[pu.key()] = pu
 	}
 	return pTUrls
 }
 
 // parseYAML uses the `yaml` package to parse the YAML bytes into the Type struct pathURL
-//  * yaml.Unmarshal reads `all` the content into memory at once
-func parseYAML(yB []byte) (pathUrls []PathURL, err error) {
-	err = yaml.Unmarshal(yB, &pathUrls)
+//  * decodeYAML reads `all` the content into memory at once, keeping the line number of each mapping
+//  * FilterPathUrls rejects the whole file when any mapping is invalid, naming its line, or skips a disallowed url when policy says so
+func parseYAML(yB []byte, policy URLPolicy) ([]PathURL, error) {
+	pathUrls, lines, err := decodeYAML(yB)
 	if err != nil {
 		return nil, err
 	}
-	return pathUrls, nil
+	return FilterPathUrls(pathUrls, policy, func(i int) string { return fmt.Sprintf("line %d", lines[i]) })
 }
 
 // parseJSON uses the `json` package to parse the JSON bytes into the Type struct pathURL
-//  * json.Unmarshal reads `all` the content into memory at once
-func parseJSON(jB []byte) (pathUrls []PathURL, err error) {
-	err = json.Unmarshal(jB, &pathUrls)
+//  * decodeJSON reads `all` the content into memory at once, keeping the line number of each mapping
+//  * FilterPathUrls rejects the whole file when any mapping is invalid, naming its line, or skips a disallowed url when policy says so
+func parseJSON(jB []byte, policy URLPolicy) ([]PathURL, error) {
+	pathUrls, lines, err := decodeJSON(jB)
 	if err != nil {
 		return nil, err
 	}
-	return pathUrls, nil
+	return FilterPathUrls(pathUrls, policy, func(i int) string { return fmt.Sprintf("line %d", lines[i]) })
+}
+
+// decodeYAML decodes the YAML bytes into mappings, without checking them, along with the line each mapping starts on
+func decodeYAML(yB []byte) (pathUrls []PathURL, lines []int, err error) {
+	var nodes []yaml.Node
+	if err = yaml.Unmarshal(yB, &nodes); err != nil {
+		return nil, nil, err
+	}
+	pathUrls, lines = make([]PathURL, len(nodes)), make([]int, len(nodes))
+	for i := range nodes {
+		if err = nodes[i].Decode(&pathUrls[i]); err != nil {
+			return nil, nil, err
+		}
+		lines[i] = nodes[i].Line
+	}
+	return pathUrls, lines, nil
+}
+
+// decodeJSON decodes the JSON bytes into mappings, without checking them, along with the line each mapping starts on
+//  * the raw bytes of each mapping are an exact copy of the input, so they are found again in order to count the lines before them
+func decodeJSON(jB []byte) (pathUrls []PathURL, lines []int, err error) {
+	var raws []json.RawMessage
+	if err = json.Unmarshal(jB, &raws); err != nil {
+		return nil, nil, err
+	}
+	pathUrls, lines = make([]PathURL, len(raws)), make([]int, len(raws))
+	offset := 0
+	for i, raw := range raws {
+		if err = json.Unmarshal(raw, &pathUrls[i]); err != nil {
+			return nil, nil, err
+		}
+		offset += bytes.Index(jB[offset:], raw)
+		lines[i] = bytes.Count(jB[:offset], []byte("\n")) + 1
+		offset += len(raw)
+	}
+	return pathUrls, lines, nil
 }
@@ -0,0 +1,140 @@
+package goUrlShortener
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// define the health check paths, served by HealthHandler ahead of every mapping
+// * HealthzPath answers as long as the process serves requests
+// * ReadyzPath answers 200 only while every source is loaded and the database answers a ping
+const (
+	HealthzPath = "/healthz"
+	ReadyzPath  = "/readyz"
+)
+
+// readyPingTimeout bounds the database ping of a readiness check, so that a hung database fails the check rather than the probe
+const readyPingTimeout = 2 * time.Second
+
+// ReloadReporter is implemented by Stores that reload their mappings from their source
+//  * LastReload returns when the mappings were last loaded, and the error of the last reload while it keeps failing
+type ReloadReporter interface {
+	LastReload() (at time.Time, err error)
+}
+
+// reloadStatus records the outcome of the reloads of a source, making its Store a ReloadReporter
+type reloadStatus struct {
+	mu  sync.Mutex
+	at  time.Time
+	err error
+}
+
+// record notes the outcome of a reload
+//  * changed reports that the mappings were replaced, and current that the source was read and still holds the mappings served
+//  * a failure is kept until a later reload is changed or current, since an unchanged broken file is not parsed again
+//  * so a file that was briefly missing, and came back as it was, is healthy again without a SIGHUP
+func (rs *reloadStatus) record(changed, current bool, err error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if err != nil {
+		rs.err = err
+		return
+	}
+	if changed {
+		rs.at = time.Now()
+	}
+	if changed || current {
+		rs.err = nil
+	}
+}
+
+// LastReload returns when the mappings were last loaded, and the error of the last reload while it keeps failing
+func (rs *reloadStatus) LastReload() (time.Time, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.at, rs.err
+}
+
+// HealthSources declares what the readiness check looks at
+//  * a layer of Store that implements ReloadReporter is not ready while its reload is failing
+//  * DB is not ready while it does not answer a ping
+//  * either may be left nil
+type HealthSources struct {
+	Store *LayeredStore
+	DB    *sql.DB
+}
+
+// sourceHealth is the state of one source, or of the database, in the body of a readiness check
+type sourceHealth struct {
+	Name       string     `json:"name"`
+	Status     string     `json:"status"`
+	LastReload *time.Time `json:"last_reload,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// readiness is the body of a readiness check
+type readiness struct {
+	Status   string         `json:"status"`
+	Sources  []sourceHealth `json:"sources"`
+	Database *sourceHealth  `json:"database,omitempty"`
+}
+
+// HealthHandler serves HealthzPath and ReadyzPath ahead of next, so that no mapping can shadow them
+//  * every other request is passed on to next
+func HealthHandler(sources HealthSources, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case HealthzPath:
+			writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		case ReadyzPath:
+			serveReady(w, r, sources)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// serveReady answers 200 with the state of every source and of the database, or 503 when any of them is failing
+func serveReady(w http.ResponseWriter, r *http.Request, sources HealthSources) {
+	body := readiness{Status: "ready", Sources: []sourceHealth{}}
+	if sources.Store != nil {
+		for _, l := range sources.Store.Layers() {
+			sh := sourceHealth{Name: l.Name, Status: "ok"}
+			if reporter, ok := l.Store.(ReloadReporter); ok {
+				at, err := reporter.LastReload()
+				if !at.IsZero() {
+					sh.LastReload = &at
+				}
+				if err != nil {
+					sh.Status, sh.Error = "failing", err.Error()
+					body.Status = "unavailable"
+				}
+			}
+			body.Sources = append(body.Sources, sh)
+		}
+	}
+	if sources.DB != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), readyPingTimeout)
+		defer cancel()
+		body.Database = &sourceHealth{Name: "sql", Status: "ok"}
+		if err := sources.DB.PingContext(ctx); err != nil {
+			body.Database.Status, body.Database.Error = "failing", err.Error()
+			body.Status = "unavailable"
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if body.Status != "ready" {
+		writeJSON(w, http.StatusServiceUnavailable, body)
+		return
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+// isHealthPath reports whether path is served by HealthHandler, so that no link may take it
+func isHealthPath(path string) bool {
+	return path == HealthzPath || path == ReadyzPath
+}
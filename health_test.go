@@ -0,0 +1,110 @@
+package goUrlShortener
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// reportingStore is a MemoryStore whose reloads last ended at `at`, with err
+type reportingStore struct {
+	*MemoryStore
+	at  time.Time
+	err error
+}
+
+func (rs reportingStore) LastReload() (time.Time, error) {
+	return rs.at, rs.err
+}
+
+func TestServeReady(t *testing.T) {
+	loaded := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	unreachable, err := sql.Open("postgres", "host=127.0.0.1 port=1 sslmode=disable connect_timeout=1") // nothing listens on port 1
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unreachable.Close()
+
+	store := NewMemoryStore(nil)
+	tests := []struct {
+		name     string
+		sources  HealthSources
+		code     int
+		status   string
+		layers   []string // the status of each layer, in order
+		database string   // the status of the database, empty when there is none
+	}{
+		{"nothing to check", HealthSources{}, http.StatusOK, "ready", []string{}, ""},
+		{"layers without reloads", HealthSources{Store: NewLayeredStore(Layer{Name: "inline", Store: store})}, http.StatusOK, "ready", []string{"ok"}, ""},
+		{
+			"reloaded layers",
+			HealthSources{Store: NewLayeredStore(Layer{Name: "yaml", Store: reportingStore{store, loaded, nil}}, Layer{Name: "inline", Store: store})},
+			http.StatusOK, "ready", []string{"ok", "ok"}, "",
+		},
+		{
+			"a failing reload",
+			HealthSources{Store: NewLayeredStore(Layer{Name: "yaml", Store: reportingStore{store, loaded, errors.New("bad yaml")}}, Layer{Name: "inline", Store: store})},
+			http.StatusServiceUnavailable, "unavailable", []string{"failing", "ok"}, "",
+		},
+		{
+			"a source that never loaded",
+			HealthSources{Store: NewLayeredStore(Layer{Name: "yaml", Store: reportingStore{store, time.Time{}, errors.New("missing")}})},
+			http.StatusServiceUnavailable, "unavailable", []string{"failing"}, "",
+		},
+		{"an unreachable database", HealthSources{DB: unreachable}, http.StatusServiceUnavailable, "unavailable", []string{}, "failing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			HealthHandler(tt.sources, http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest("GET", ReadyzPath, nil))
+			if rec.Code != tt.code {
+				t.Errorf("code = %d, want %d", rec.Code, tt.code)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", got)
+			}
+			var body readiness
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Status != tt.status {
+				t.Errorf("status = %q, want %q", body.Status, tt.status)
+			}
+			layers := []string{}
+			for i, sh := range body.Sources {
+				layers = append(layers, sh.Status)
+				if layer := tt.sources.Store.Layers()[i]; sh.Name != layer.Name {
+					t.Errorf("source %d is named %q, want %q", i, sh.Name, layer.Name)
+				}
+				if (sh.Status == "failing") != (sh.Error != "") {
+					t.Errorf("source %s has status %q with error %q", sh.Name, sh.Status, sh.Error)
+				}
+				if rs, ok := tt.sources.Store.Layers()[i].Store.(reportingStore); ok && !rs.at.IsZero() {
+					if sh.LastReload == nil || !sh.LastReload.Equal(rs.at) {
+						t.Errorf("source %s last reloaded at %v, want %v", sh.Name, sh.LastReload, rs.at)
+					}
+				} else if sh.LastReload != nil {
+					t.Errorf("source %s last reloaded at %v, want none", sh.Name, sh.LastReload)
+				}
+			}
+			if !reflect.DeepEqual(layers, tt.layers) {
+				t.Errorf("sources = %v, want %v", layers, tt.layers)
+			}
+			database := ""
+			if body.Database != nil {
+				database = body.Database.Status
+				if body.Database.Error == "" && database == "failing" {
+					t.Errorf("the failing database has no error")
+				}
+			}
+			if database != tt.database {
+				t.Errorf("database = %q, want %q", database, tt.database)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package goUrlShortener
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// HostKey returns the key a Store holds the mapping for host and path under
+//  * a mapping without a host is a catch-all, served on every host, and is keyed by its path alone
+//  * a mapping with a host is only served on that host, and is keyed by the host followed by its path e.g. `go.corp/promo`
+//  * hosts are case-insensitive, so they are lowercased
+func HostKey(host, path string) string {
+	return strings.ToLower(host) + path
+}
+
+// splitHostKey splits a key made by HostKey back into its host and path
+//  * the path of a host-scoped mapping always starts with `/` (see CheckPathUrls), so the host is whatever comes before the first `/`
+func splitHostKey(key string) (host, path string) {
+	i := strings.Index(key, "/")
+	if i <= 0 {
+		return "", key
+	}
+	return key[:i], key[i:]
+}
+
+// key returns the key a Store holds pu under
+func (pu PathURL) key() string {
+	return HostKey(pu.Host, pu.Path)
+}
+
+// requestHost returns the lowercased host a request was sent to, without its port
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// checkHost rejects hosts that could never match a request, or that would make a key ambiguous
+func checkHost(host string) error {
+	if strings.ContainsAny(host, "/:?# ") {
+		return errors.Errorf("invalid host %q, use a bare host name without scheme, port or path", host)
+	}
+	return nil
+}
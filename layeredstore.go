@@ -0,0 +1,307 @@
+package goUrlShortener
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Layer names a Store, so that LayeredStore can report which source resolved a path
+type Layer struct {
+	Name  string
+	Store Store
+}
+
+// LayeredStore is a Store that combines several Stores in priority order
+//  * Lookup tries each layer in turn, so a path in an earlier layer wins and a miss falls through to the next layer
+//  * Put and Delete only touch the write layer, which is the first layer unless SetWriteLayer picks another one
+//  * List merges every layer, keeping the mapping from the earliest layer when a path is in several layers
+//  * ListPage merges a page the same way, reading only that page from a layer that implements Pager
+type LayeredStore struct {
+	layers     []Layer
+	writeLayer int
+}
+
+// NewLayeredStore returns a LayeredStore over the layers, highest priority first
+func NewLayeredStore(layers ...Layer) *LayeredStore {
+	return &LayeredStore{layers: layers}
+}
+
+// Layers returns the layers, highest priority first
+func (ls *LayeredStore) Layers() []Layer {
+	return ls.layers
+}
+
+// SetWriteLayer picks the layer, by name, that Put and Delete write to
+func (ls *LayeredStore) SetWriteLayer(name string) error {
+	for i, l := range ls.layers {
+		if l.Name == name {
+			ls.writeLayer = i
+			return nil
+		}
+	}
+	return errors.Errorf("no layer named: %s", name)
+}
+
+// Resolve looks up key in each layer in turn, and returns the name of the layer that holds it
+func (ls *LayeredStore) Resolve(key string) (pu PathURL, source string, ok bool, err error) {
+	for _, l := range ls.layers {
+		pu, ok, err = l.Store.Lookup(key)
+		if err != nil {
+			return PathURL{}, l.Name, false, errors.Wrapf(err, "layer %s", l.Name)
+		}
+		if ok {
+			return pu, l.Name, true, nil
+		}
+	}
+	return PathURL{}, "", false, nil
+}
+
+// Lookup returns the mapping for key from the highest priority layer that holds it
+func (ls *LayeredStore) Lookup(key string) (PathURL, bool, error) {
+	pu, _, ok, err := ls.Resolve(key)
+	return pu, ok, err
+}
+
+// Patterns returns the pattern rules of every layer that implements PatternLister
+//  * the rules of an earlier layer all come before those of a later one
+//  * a rule shadowed by the same pattern in an earlier layer is left out
+func (ls *LayeredStore) Patterns() ([]PathURL, error) {
+	var patterns []PathURL
+	seen := make(map[string]bool)
+	for _, l := range ls.layers {
+		lister, ok := l.Store.(PatternLister)
+		if !ok {
+			continue
+		}
+		layerPatterns, err := lister.Patterns()
+		if err != nil {
+			return nil, errors.Wrapf(err, "layer %s", l.Name)
+		}
+		for _, pu := range layerPatterns {
+			if !seen[pu.key()] {
+				seen[pu.key()] = true
+				patterns = append(patterns, pu)
+			}
+		}
+	}
+	return patterns, nil
+}
+
+// Put creates or replaces the mapping for the key of pu in the write layer
+func (ls *LayeredStore) Put(pu PathURL) error {
+	if len(ls.layers) == 0 {
+		return errors.New("no layer to write to")
+	}
+	return ls.layers[ls.writeLayer].Store.Put(pu)
+}
+
+// Delete removes the mapping for key from the write layer
+//  * a mapping for the same key in another layer is left alone, and is served from then on
+func (ls *LayeredStore) Delete(key string) error {
+	if len(ls.layers) == 0 {
+		return ErrNotFound
+	}
+	return ls.layers[ls.writeLayer].Store.Delete(key)
+}
+
+// List merges the mappings of every layer, sorted by host then path
+func (ls *LayeredStore) List() ([]PathURL, error) {
+	resolved, err := ls.resolveAll()
+	if err != nil {
+		return nil, err
+	}
+	pathUrls := make([]PathURL, 0, len(resolved))
+	for _, rp := range resolved {
+		pathUrls = append(pathUrls, rp.PathURL)
+	}
+	return pathUrls, nil
+}
+
+// ListPage lists a page of the merged mappings, sorted by host then path, reading a single page from the one layer that implements Pager
+//  * the total is left at -1 when the Pager did not count it
+//  * the other layers are listed in full, so they are expected to be small e.g. the mapping files and the inline mappings
+//  * the keys held by earlier layers are excluded from the Pager's page, and each key of a later layer is looked up in the Pager
+//  * without exactly one Pager layer, every layer is listed and the page is cut from the merged mappings
+func (ls *LayeredStore) ListPage(filter ListFilter, offset, limit int, count bool) ([]PathURL, int, error) {
+	pagerAt, pagers := -1, 0
+	for i, l := range ls.layers {
+		if _, ok := l.Store.(Pager); ok {
+			pagerAt, pagers = i, pagers+1
+		}
+	}
+	if pagers != 1 {
+		pathUrls, err := ls.List()
+		if err != nil {
+			return nil, 0, err
+		}
+		page, total := listPage(pathUrls, filter, offset, limit)
+		return page, total, nil
+	}
+
+	// resolve the other layers, leaving out the keys that the Pager layer shadows
+	pagerLayer := ls.layers[pagerAt]
+	seen := make(map[string]bool)
+	var others []PathURL
+	var exclude []string
+	for i, l := range ls.layers {
+		if i == pagerAt {
+			continue
+		}
+		pathUrls, err := l.Store.List()
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "layer %s", l.Name)
+		}
+		for _, pu := range pathUrls {
+			key := pu.key()
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if i < pagerAt {
+				exclude = append(exclude, key)
+			} else if _, held, err := pagerLayer.Store.Lookup(key); err != nil {
+				return nil, 0, errors.Wrapf(err, "layer %s", pagerLayer.Name)
+			} else if held {
+				continue
+			}
+			if filter.matches(pu) {
+				others = append(others, pu)
+			}
+		}
+	}
+	sortPathUrls(others)
+
+	// every merged mapping before the page is either one of others, or a Pager row before start
+	start := offset - len(others)
+	if start < 0 {
+		start = 0
+	}
+	pagerFilter := filter
+	pagerFilter.Exclude = append(append([]string(nil), filter.Exclude...), exclude...)
+	rows, total, err := pagerLayer.Store.(Pager).ListPage(pagerFilter, start, offset+limit-start, count)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "layer %s", pagerLayer.Name)
+	}
+
+	page := make([]PathURL, 0, limit)
+	o, r := 0, 0
+	for len(page) < limit && (o < len(others) || r < len(rows)) {
+		at := start + r + o // the position of the next mapping in the merged order, exact from offset on
+		var pu PathURL
+		if r == len(rows) || o < len(others) && lessPathURL(others[o], rows[r]) {
+			pu, o = others[o], o+1
+		} else {
+			pu, r = rows[r], r+1
+		}
+		if at >= offset {
+			page = append(page, pu)
+		}
+	}
+	if total < 0 { // not counted by the Pager
+		return page, total, nil
+	}
+	return page, total + len(others), nil
+}
+
+// resolvedPath declares the report DebugHandler gives for a single mapping
+//  * Source is the layer that serves the mapping
+//  * Shadowed lists the lower priority layers that also hold a mapping for the same host and path
+type resolvedPath struct {
+	PathURL
+	Source   string   `json:"source"`
+	Shadowed []string `json:"shadowed,omitempty"`
+}
+
+// debugReport declares a resolvedPath as DebugHandler shows it, without the password hash, as the links API does
+type debugReport struct {
+	linkResponse
+	Source   string   `json:"source"`
+	Shadowed []string `json:"shadowed,omitempty"`
+}
+
+// newDebugReport returns rp without its password hash
+func newDebugReport(rp resolvedPath) debugReport {
+	return debugReport{linkResponse: newLinkResponse(rp.PathURL), Source: rp.Source, Shadowed: rp.Shadowed}
+}
+
+// resolvePath looks up key in every layer and works out which layer serves it
+func (ls *LayeredStore) resolvePath(key string) (rp resolvedPath, ok bool, err error) {
+	for _, l := range ls.layers {
+		pu, found, err := l.Store.Lookup(key)
+		if err != nil {
+			return resolvedPath{}, false, errors.Wrapf(err, "layer %s", l.Name)
+		}
+		switch {
+		case found && !ok:
+			rp, ok = resolvedPath{PathURL: pu, Source: l.Name}, true
+		case found:
+			rp.Shadowed = append(rp.Shadowed, l.Name)
+		}
+	}
+	return rp, ok, nil
+}
+
+// resolveAll lists every layer and works out which layer serves each key, sorted by host then path
+func (ls *LayeredStore) resolveAll() ([]resolvedPath, error) {
+	byKey := make(map[string]*resolvedPath)
+	for _, l := range ls.layers {
+		pathUrls, err := l.Store.List()
+		if err != nil {
+			return nil, errors.Wrapf(err, "layer %s", l.Name)
+		}
+		for _, pu := range pathUrls {
+			if rp, ok := byKey[pu.key()]; ok {
+				rp.Shadowed = append(rp.Shadowed, l.Name)
+				continue
+			}
+			byKey[pu.key()] = &resolvedPath{PathURL: pu, Source: l.Name}
+		}
+	}
+
+	resolved := make([]resolvedPath, 0, len(byKey))
+	for _, rp := range byKey {
+		resolved = append(resolved, *rp)
+	}
+	sort.Slice(resolved, func(i, j int) bool { return lessPathURL(resolved[i].PathURL, resolved[j].PathURL) })
+	return resolved, nil
+}
+
+// DebugHandler will return an http.HandlerFunc that reports which layer resolves each path, as JSON
+//  * `?path=<path>` reports the single path, or responds 404 when no layer holds it
+//  * `&host=<host>` reports the mapping scoped to that host instead of the catch-all one
+//  * without a query, it reports every mapping held by any layer
+//  * password hashes are left out, only whether each mapping is protected is reported
+func DebugHandler(ls *LayeredStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var report interface{}
+		if path := r.URL.Query().Get("path"); path != "" {
+			rp, ok, err := ls.resolvePath(HostKey(r.URL.Query().Get("host"), path))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.Error(w, "no layer resolves path: "+path, http.StatusNotFound)
+				return
+			}
+			report = newDebugReport(rp)
+		} else {
+			resolved, err := ls.resolveAll()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			reports := make([]debugReport, len(resolved))
+			for i, rp := range resolved {
+				reports[i] = newDebugReport(rp)
+			}
+			report = reports
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,143 @@
+package goUrlShortener
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// memoryPager is a MemoryStore that pages like a PostgresStore, leaving the total uncounted unless asked
+type memoryPager struct {
+	*MemoryStore
+}
+
+func (mp memoryPager) ListPage(filter ListFilter, offset, limit int, count bool) ([]PathURL, int, error) {
+	pathUrls, _ := mp.List()
+	page, total := listPage(pathUrls, filter, offset, limit)
+	if !count {
+		total = -1
+	}
+	return page, total, nil
+}
+
+// randomMappings returns n mappings over a few hosts and paths, so that layers share some keys
+func randomMappings(rnd *rand.Rand, n int, url string) []PathURL {
+	hosts := []string{"", "", "go", "go.corp"}
+	pathUrls := make([]PathURL, n)
+	for i := range pathUrls {
+		pathUrls[i] = PathURL{Host: hosts[rnd.Intn(len(hosts))], Path: fmt.Sprintf("/p%d", rnd.Intn(30)), URL: url}
+	}
+	return pathUrls
+}
+
+func TestLayeredStoreListPage(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	filters := []ListFilter{{}, {Host: "go", ByHost: true}, {Prefix: "/p1"}, {Contains: "layer1"}}
+	for round := 0; round < 200; round++ {
+		pagerAt := rnd.Intn(3)
+		var layers []Layer
+		for i := 0; i < 3; i++ {
+			store := NewMemoryStore(randomMappings(rnd, rnd.Intn(20), fmt.Sprintf("https://example.com/layer%d", i)))
+			if i == pagerAt {
+				layers = append(layers, Layer{Name: "sql", Store: memoryPager{store}})
+			} else {
+				layers = append(layers, Layer{Name: fmt.Sprintf("file%d", i), Store: store})
+			}
+		}
+		ls := NewLayeredStore(layers...)
+		merged, _ := ls.List()
+
+		filter := filters[rnd.Intn(len(filters))]
+		offset, limit := rnd.Intn(40), 1+rnd.Intn(15)
+		want, wantTotal := listPage(merged, filter, offset, limit)
+		for _, count := range []bool{true, false} {
+			page, total, err := ls.ListPage(filter, offset, limit, count)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(page, want) {
+				t.Fatalf("round %d: ListPage(%+v, %d, %d) = %v, want %v", round, filter, offset, limit, page, want)
+			}
+			if count && total != wantTotal || !count && total != -1 {
+				t.Fatalf("round %d: ListPage total = %d with count %v, want %d", round, total, count, wantTotal)
+			}
+		}
+	}
+}
+
+// failingStore is a Store whose every Lookup fails
+type failingStore struct {
+	*MemoryStore
+}
+
+func (failingStore) Lookup(string) (PathURL, bool, error) {
+	return PathURL{}, false, fmt.Errorf("connection refused")
+}
+
+func TestLayeredStoreResolve(t *testing.T) {
+	ls := NewLayeredStore(
+		Layer{Name: "yaml", Store: NewMemoryStore([]PathURL{{Path: "/both", URL: "https://example.com/yaml"}})},
+		Layer{Name: "inline", Store: NewMemoryStore([]PathURL{
+			{Path: "/both", URL: "https://example.com/inline"},
+			{Path: "/inline", URL: "https://example.com/inline"},
+			{Host: "go", Path: "/inline", URL: "https://example.com/go"},
+		})},
+	)
+	tests := []struct {
+		key, source, url string
+		ok               bool
+	}{
+		{"/both", "yaml", "https://example.com/yaml", true},
+		{"/inline", "inline", "https://example.com/inline", true},
+		{"go/inline", "inline", "https://example.com/go", true},
+		{"/missing", "", "", false},
+	}
+	for _, tt := range tests {
+		pu, source, ok, err := ls.Resolve(tt.key)
+		if err != nil || ok != tt.ok || source != tt.source || pu.URL != tt.url {
+			t.Errorf("Resolve(%q) = %s from %q, %v, %v, want %s from %q, %v", tt.key, pu.URL, source, ok, err, tt.url, tt.source, tt.ok)
+		}
+	}
+
+	broken := NewLayeredStore(append([]Layer{{Name: "sql", Store: failingStore{NewMemoryStore(nil)}}}, ls.Layers()...)...)
+	if _, source, _, err := broken.Resolve("/both"); err == nil || source != "sql" {
+		t.Errorf("Resolve through a failing layer = %q, %v, want the error of the sql layer", source, err)
+	}
+}
+
+func TestLayeredStoreListPageShadowing(t *testing.T) {
+	ls := NewLayeredStore(
+		Layer{Name: "sql", Store: memoryPager{NewMemoryStore([]PathURL{
+			{Path: "/a", URL: "https://example.com/sql"},
+			{Path: "/c", URL: "https://example.com/sql"},
+		})}},
+		Layer{Name: "yaml", Store: NewMemoryStore([]PathURL{
+			{Path: "/a", URL: "https://example.com/yaml"},
+			{Path: "/b", URL: "https://example.com/yaml"},
+		})},
+	)
+	tests := []struct {
+		offset, limit int
+		paths         string
+		total         int
+	}{
+		{0, 10, "/a:sql /b:yaml /c:sql", 3},
+		{1, 1, "/b:yaml", 3},
+		{2, 5, "/c:sql", 3},
+		{3, 5, "", 3},
+	}
+	for _, tt := range tests {
+		page, total, err := ls.ListPage(ListFilter{}, tt.offset, tt.limit, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, pu := range page {
+			paths = append(paths, pu.Path+":"+pu.URL[len("https://example.com/"):])
+		}
+		if got := fmt.Sprint(paths); got != "["+tt.paths+"]" || total != tt.total {
+			t.Errorf("ListPage(%d, %d) = %s of %d, want [%s] of %d", tt.offset, tt.limit, got, total, tt.paths, tt.total)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	gUS "github.com/damilarelana/goUrlShortener"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// define flags
+var configFilename *string = flag.String("config", "", "a yaml file setting any flag by its name e.g. `listen: \":8080\"`, plus the inline `mappings`; URLSHORT_* environment variables override it, and flags override both")
+var listenAddr *string = flag.String("listen", ":8080", "the address the server listens on")
+var adminListen *string = flag.String("admin-listen", "localhost:8081", "the address the links API and the metrics listen on, apart from the short links; empty disables both")
+var adminToken *string = flag.String("admin-token", "", "the bearer token the links API and the metrics require, needed unless -admin-listen is a loopback address")
+var defaultYAML *string = flag.String("default-yaml", "pathsData.yaml", "the yaml file used when no -yaml, -json or -sql source is set, empty to serve the inline mappings alone")
+
+// envPrefix starts the name of the environment variable that sets a flag e.g. URLSHORT_DEFAULT_STATUS for `-default-status`
+const envPrefix = "URLSHORT_"
+
+// redacted replaces the secret part of a value that is printed
+const redacted = "REDACTED"
+
+// defaultMappings are the inline mappings, used when the config file sets no `mappings`
+var defaultMappings = []gUS.PathURL{
+	{Path: "/urlshort-godoc", URL: "https://godoc.org/github.com/gophercises/urlshort"},
+	{Path: "/yaml-godoc", URL: "https://godoc.org/gopkg.in/yaml.v2"},
+}
+
+// secretFlags redact the secrets out of the value of a flag before it is printed
+var secretFlags = map[string]func(string) string{
+	"admin-token": func(string) string { return redacted },
+	"cookie-key":  func(string) string { return redacted },
+	"sql":         gUS.RedactDSN,
+}
+
+// config holds the effective configuration
+//  * Sources names where each flag got its value: flag, env, file or default
+//  * Mappings are the inline mappings, as written, and MappingLines the line each starts on in the `-config` file
+type config struct {
+	Sources      map[string]string
+	Mappings     []gUS.PathURL
+	MappingLines []int
+}
+
+// loadConfig()
+//  * parses the command line flags in args
+//  * then, for every flag not set on the command line, takes its URLSHORT_* environment variable, or its key in the `-config` file
+//  * reads the inline `mappings` from the `-config` file, or uses defaultMappings, leaving their checks to inlineMappings()
+//  * exits when the file has an unknown key, or a value does not parse
+func loadConfig(args []string) config {
+	errMsgHandler(fmt.Sprintf("Failed to parse the flags"), flag.CommandLine.Parse(args))
+	cfg := config{Sources: make(map[string]string), Mappings: defaultMappings}
+	flag.Visit(func(f *flag.Flag) { cfg.Sources[f.Name] = "flag" })
+
+	setFromEnv := func(f *flag.Flag) {
+		if _, set := cfg.Sources[f.Name]; set {
+			return
+		}
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			errMsgHandler(fmt.Sprintf("Invalid %s:", envName(f.Name)), f.Value.Set(value))
+			cfg.Sources[f.Name] = "env"
+		}
+	}
+	setFromEnv(flag.Lookup("config")) // the file itself may be named by URLSHORT_CONFIG
+	flag.VisitAll(setFromEnv)
+
+	if *configFilename != "" {
+		values, mappings, lines, err := configFileReader(*configFilename)
+		errMsgHandler(fmt.Sprintf("Failed to read the config file: %s\n", *configFilename), err)
+		for name, value := range values {
+			if _, set := cfg.Sources[name]; set {
+				continue
+			}
+			errMsgHandler(fmt.Sprintf("Invalid %s in the config file:", name), flag.Set(name, value))
+			cfg.Sources[name] = "file"
+		}
+		if mappings != nil {
+			cfg.Mappings, cfg.MappingLines = mappings, lines
+		}
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if _, set := cfg.Sources[f.Name]; !set {
+			cfg.Sources[f.Name] = "default"
+		}
+	})
+	return cfg
+}
+
+// configFileReader()
+//  * reads the `-config` file, a yaml mapping of flag names to values
+//  * joins a list value with commas, for the flags that take a comma separated list
+//  * decodes the `mappings` key into the inline mappings, nil when it is missing, along with the line each starts on
+func configFileReader(filename string) (values map[string]string, mappings []gUS.PathURL, lines []int, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var nodes map[string]yaml.Node
+	if err = yaml.Unmarshal(data, &nodes); err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to parse")
+	}
+
+	values = make(map[string]string, len(nodes))
+	for name, node := range nodes {
+		switch {
+		case name == "mappings":
+			mappings = []gUS.PathURL{}
+			if err = node.Decode(&mappings); err != nil {
+				return nil, nil, nil, errors.Wrapf(err, "line %d: mappings", node.Line)
+			}
+			for _, item := range node.Content {
+				lines = append(lines, item.Line)
+			}
+		case name == "config" || flag.Lookup(name) == nil:
+			return nil, nil, nil, errors.Errorf("line %d: unknown key %q", node.Line, name)
+		case node.Kind == yaml.SequenceNode:
+			items := make([]string, len(node.Content))
+			for i, item := range node.Content {
+				items[i] = item.Value
+			}
+			values[name] = strings.Join(items, ",")
+		case node.Kind == yaml.ScalarNode:
+			values[name] = node.Value
+		default:
+			return nil, nil, nil, errors.Errorf("line %d: %s must be a value or a list of values", node.Line, name)
+		}
+	}
+	return values, mappings, lines, nil
+}
+
+// inlineMappings()
+//  * checks the inline mappings against policy, the way the yaml, json and sql sources are checked
+//  * skips and logs a disallowed url when policy says so, naming its line in the `-config` file
+//  * exits when any other mapping is invalid
+func inlineMappings(cfg config, policy gUS.URLPolicy) []gUS.PathURL {
+	source := "the inline mappings"
+	locate := func(i int) string { return fmt.Sprintf("item %d", i+1) }
+	if cfg.MappingLines != nil {
+		source = *configFilename
+		locate = func(i int) string { return fmt.Sprintf("line %d", cfg.MappingLines[i]) }
+	}
+	mappings, err := gUS.FilterPathUrls(cfg.Mappings, policy, locate)
+	if err != nil {
+		errMsgHandler(fmt.Sprintf("Invalid mappings in the config file:"), &gUS.ParseError{Source: source, Err: err})
+	}
+	return mappings
+}
+
+// envName returns the environment variable that sets the flag name
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// checkConfig()
+//  * rejects the flag values that parse, but that the server cannot use
+func checkConfig() {
+	errMsgHandler(fmt.Sprintf("Invalid -default-status"), gUS.CheckStatus(*defaultStatus))
+	errMsgHandler(fmt.Sprintf("Invalid -default-query"), gUS.CheckQueryPolicy(gUS.QueryPolicy(*defaultQuery)))
+	_, err := gUS.ParseLogLevel(*logLevel)
+	errMsgHandler(fmt.Sprintf("Invalid -log-level"), err)
+	if *invalidURLs != "reject" && *invalidURLs != "skip" {
+		errMsgHandler(fmt.Sprintf("Invalid -invalid-urls:"), errors.Errorf("%q, use reject or skip", *invalidURLs))
+	}
+	if *adminListen != "" && *adminToken == "" && !isLoopback(*adminListen) {
+		errMsgHandler(fmt.Sprintf("Invalid -admin-listen:"), errors.Errorf("%s is not a loopback address, set -admin-token to expose the links API on it", *adminListen))
+	}
+}
+
+// printConfig()
+//  * prints the effective configuration as a config file, each value followed by where it came from
+//  * redacts the secrets of secretFlags, and the password hashes of the inline mappings
+func printConfig(cfg config) {
+	var names []string
+	flag.VisitAll(func(f *flag.Flag) { names = append(names, f.Name) })
+	sort.Strings(names)
+
+	fmt.Println("# the effective configuration, each value followed by where it came from")
+	for _, name := range names {
+		if name == "config" {
+			fmt.Printf("# config: %q  # %s\n", *configFilename, cfg.Sources[name])
+			continue
+		}
+		value := flag.Lookup(name).Value.String()
+		if redact, ok := secretFlags[name]; ok && value != "" {
+			value = redact(value)
+		}
+		fmt.Printf("%s: %q  # %s\n", name, value, cfg.Sources[name])
+	}
+
+	mappings := make([]gUS.PathURL, len(cfg.Mappings))
+	for i, pu := range cfg.Mappings {
+		if pu.PasswordHash != "" {
+			pu.PasswordHash = redacted
+		}
+		mappings[i] = pu
+	}
+	data, err := yaml.Marshal(map[string][]gUS.PathURL{"mappings": mappings})
+	errMsgHandler(fmt.Sprintf("Failed to print the inline mappings"), err)
+	fmt.Print(string(data))
+}
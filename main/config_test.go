@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// freshFlags lets loadConfig parse the command line again, as if the process had just started
+//  * the flags keep their variables, but move to a new flag.CommandLine that has parsed nothing
+//  * our own flags go back to their defaults, those of the test binary keep their values
+func freshFlags(t *testing.T) {
+	saved := flag.CommandLine
+	reset := func() {
+		saved.VisitAll(func(f *flag.Flag) {
+			if !strings.HasPrefix(f.Name, "test.") {
+				f.Value.Set(f.DefValue)
+			}
+		})
+	}
+	reset()
+	fresh := flag.NewFlagSet(saved.Name(), flag.ContinueOnError)
+	saved.VisitAll(func(f *flag.Flag) { fresh.Var(f.Value, f.Name, f.Usage) })
+	flag.CommandLine = fresh
+	t.Cleanup(func() {
+		flag.CommandLine = saved
+		reset()
+	})
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	file := "listen: \":1\"\nadmin-listen: \"localhost:2\"\ndefault-yaml: links.yaml\n"
+	if err := ioutil.WriteFile(filename, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	type value struct{ value, source string }
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want map[string]value // by flag name
+	}{
+		{
+			name: "defaults",
+			want: map[string]value{"listen": {":8080", "default"}, "admin-listen": {"localhost:8081", "default"}, "default-yaml": {"pathsData.yaml", "default"}},
+		},
+		{
+			name: "file over defaults",
+			args: []string{"-config", filename},
+			want: map[string]value{"listen": {":1", "file"}, "admin-listen": {"localhost:2", "file"}, "default-yaml": {"links.yaml", "file"}},
+		},
+		{
+			name: "env over file",
+			args: []string{"-config", filename},
+			env:  map[string]string{"URLSHORT_LISTEN": ":3", "URLSHORT_ADMIN_LISTEN": ""},
+			want: map[string]value{"listen": {":3", "env"}, "admin-listen": {"", "env"}, "default-yaml": {"links.yaml", "file"}},
+		},
+		{
+			name: "flag over env and file",
+			args: []string{"-config", filename, "-listen", ":4"},
+			env:  map[string]string{"URLSHORT_LISTEN": ":3", "URLSHORT_DEFAULT_YAML": "env.yaml"},
+			want: map[string]value{"listen": {":4", "flag"}, "admin-listen": {"localhost:2", "file"}, "default-yaml": {"env.yaml", "env"}},
+		},
+		{
+			name: "file named by env",
+			env:  map[string]string{"URLSHORT_CONFIG": filename},
+			want: map[string]value{"config": {filename, "env"}, "listen": {":1", "file"}},
+		},
+		{
+			name: "flag names the file over env",
+			args: []string{"-config", ""},
+			env:  map[string]string{"URLSHORT_CONFIG": filename},
+			want: map[string]value{"config": {"", "flag"}, "listen": {":8080", "default"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			freshFlags(t)
+			for _, name := range []string{"config", "listen", "admin-listen", "default-yaml"} {
+				t.Setenv(envName(name), "") // restored after the test, whatever the environment the tests run in sets
+				os.Unsetenv(envName(name))
+			}
+			for name, v := range tt.env {
+				t.Setenv(name, v)
+			}
+
+			cfg := loadConfig(tt.args)
+			got := make(map[string]value, len(tt.want))
+			for name := range tt.want {
+				got[name] = value{flag.Lookup(name).Value.String(), cfg.Sources[name]}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadConfig(%q) = %v, want %v", tt.args, got, tt.want)
+			}
+		})
+	}
+}
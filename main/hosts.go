@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	gUS "github.com/damilarelana/goUrlShortener"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// define flags
+var hostsFilename *string = flag.String("hosts", "", "a yaml file listing the short domains served, each with its own homepage and fallback url")
+
+// hostConfig declares the settings of one short domain in the `-hosts` file
+//  * Homepage is the text served on `/` of that host, the default homepage when empty
+//  * Fallback is the url that every path without a mapping on that host redirects to, the 404 page when empty
+type hostConfig struct {
+	Host     string `yaml:"host"`
+	Homepage string `yaml:"homepage"`
+	Fallback string `yaml:"fallback"`
+}
+
+// hostsFileReader()
+//  * reads and parses the `-hosts` file
+//  * checks the fallback urls against policy with checkHostFallbacks()
+//  * returns no hosts when the flag is not set, so every host shares the defaultMux()
+func hostsFileReader(hostsFilename *string, policy gUS.URLPolicy) []hostConfig {
+	if *hostsFilename == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(*hostsFilename)
+	errMsgHandler(fmt.Sprintf("Failed to read file: %s\n", *hostsFilename), err)
+
+	var nodes []yaml.Node
+	err = yaml.Unmarshal(data, &nodes)
+	errMsgHandler(fmt.Sprintf("Failed to parse the hosts file: %s\n", *hostsFilename), err)
+	hosts, lines := make([]hostConfig, len(nodes)), make([]int, len(nodes))
+	for i := range nodes {
+		err = nodes[i].Decode(&hosts[i])
+		errMsgHandler(fmt.Sprintf("Failed to parse the hosts file: %s\n", *hostsFilename), err)
+		lines[i] = nodes[i].Line
+	}
+	hosts, err = checkHostFallbacks(hosts, policy, func(i int) string { return fmt.Sprintf("%s line %d", *hostsFilename, lines[i]) })
+	errMsgHandler(fmt.Sprintf("Invalid fallback url in the hosts file: %s\n", *hostsFilename), err)
+	return hosts
+}
+
+// checkHostFallbacks()
+//  * checks the fallback url of every host against policy, as the urls of the mappings are, naming the host with locate(i)
+//  * drops and logs a disallowed fallback url when policy says so, so the host serves the 404 page instead
+//  * otherwise returns a *gUS.ParseError for the first disallowed one
+func checkHostFallbacks(hosts []hostConfig, policy gUS.URLPolicy, locate func(i int) string) ([]hostConfig, error) {
+	for i, hc := range hosts {
+		if hc.Fallback == "" {
+			continue
+		}
+		err := policy.CheckURL(hc.Fallback)
+		if err != nil && policy.SkipInvalid {
+			log.Printf("Skipping the fallback of %s: host %s: %v", locate(i), hc.Host, err)
+			hosts[i].Fallback = ""
+			continue
+		}
+		if err != nil {
+			return nil, &gUS.ParseError{Source: locate(i), Err: errors.Wrapf(err, "host %s", hc.Host)}
+		}
+	}
+	return hosts, nil
+}
+
+// hostFallbacks()
+//  * builds a fallback mux for each host in the `-hosts` file, with that host's homepage and fallback url
+//  * returns the muxes keyed by lowercase host, ready for the Redirector
+func hostFallbacks(hosts []hostConfig) map[string]http.Handler {
+	fallbacks := make(map[string]http.Handler, len(hosts))
+	for _, hc := range hosts {
+		fallbacks[strings.ToLower(hc.Host)] = defaultMux(hostHomePage(hc))
+		fmt.Printf("Now serving the host: %s\n", hc.Host)
+	}
+	return fallbacks
+}
+
+// hostHomePage()
+//  * serves the host's homepage on `/`
+//  * redirects every other path to the host's fallback url, or serves the 404 page
+func hostHomePage(hc hostConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			if hc.Fallback != "" {
+				http.Redirect(w, r, hc.Fallback, http.StatusFound)
+				return
+			}
+			custom404PageHandler(w, r, http.StatusNotFound)
+			return
+		}
+		if hc.Homepage == "" {
+			urlShortenerHomePage(w, r)
+			return
+		}
+		io.WriteString(w, hc.Homepage)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	gUS "github.com/damilarelana/goUrlShortener"
+)
+
+func TestCheckHostFallbacks(t *testing.T) {
+	policy := gUS.URLPolicy{DenyDomains: []string{"evil.example"}}
+	tests := []struct {
+		fallback    string
+		skipInvalid bool
+		want        string // the fallback kept, or the start of the error
+	}{
+		{"", false, ""},
+		{"https://example.com/home", false, "https://example.com/home"},
+		{"https://evil.example/home", false, "failed to parse hosts.yaml line 3: host sho.rt"},
+		{"javascript:alert(1)", false, "failed to parse hosts.yaml line 3: host sho.rt"},
+		{"https://evil.example/home", true, ""},
+	}
+	for _, tt := range tests {
+		policy.SkipInvalid = tt.skipInvalid
+		hosts := []hostConfig{{Host: "sho.rt", Fallback: tt.fallback}}
+		hosts, err := checkHostFallbacks(hosts, policy, func(i int) string { return fmt.Sprintf("hosts.yaml line %d", 3+i) })
+		got := ""
+		if err != nil {
+			got = err.Error()
+		} else {
+			got = hosts[0].Fallback
+		}
+		if !strings.HasPrefix(got, tt.want) || (tt.want == "" && got != "") {
+			t.Errorf("checkHostFallbacks(%q, skip %v) = %q, want %q", tt.fallback, tt.skipInvalid, got, tt.want)
+		}
+	}
+}
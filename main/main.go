@@ -1,218 +1,258 @@
 package main
 
 import (
+	"bufio"
 	"database/sql"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
 	"reflect"
-	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	gUS "github.com/damilarelana/goUrlShortener"
-	_ "github.com/lib/pq"
 	"github.com/pkg/errors"
 )
 
-// initialize the database connection parameters
-// * these are used default values for testing purposes
-// var (
-// 	host     = "localhost"
-// 	port     = 5432
-// 	user     = "postgres"
-// 	password = "brainiac"
-// 	database = "go_test_db"
-// )
-
-// // DatabaseConnectionParameter types
-// type DatabaseConnectionParameter struct {
-// 	Host     string
-// 	Port     int
-// 	UserName string
-// 	Password string
-// 	DBName   string
-// }
-
 // defines the error message handler
+// * the one place, with serve() and validateSources(), where the command decides to exit
+// * exits with a status telling the kind of failure apart, since the `goUrlShortener` package only returns errors:
+//		- 2 for a source or data source name that does not parse i.e. *gUS.ParseError
+//		- 3 for a database that cannot be reached i.e. *gUS.ConnectionError
+//		- 4 for a table that does not match the expected schema i.e. *gUS.SchemaError
+//		- 1 for any other failure
 func errMsgHandler(msg string, err error) {
 	if err != nil {
 		fmt.Println(msg, err.Error())
-		os.Exit(1)
+		os.Exit(exitStatus(err))
+	}
+}
+
+// exitStatus returns the exit status of errMsgHandler() for err
+func exitStatus(err error) int {
+	var parseErr *gUS.ParseError
+	var connErr *gUS.ConnectionError
+	var schemaErr *gUS.SchemaError
+	switch {
+	case errors.As(err, &parseErr):
+		return 2
+	case errors.As(err, &connErr):
+		return 3
+	case errors.As(err, &schemaErr):
+		return 4
 	}
+	return 1
 }
 
 // define flags
 var yamlFilename *string = flag.String("yaml", "", "a yaml file containing path and mapped URL, in a 'question, answer' format per record line")
 var jsonFilename *string = flag.String("json", "", "a json file containing path and mapped URL, in a 'question, answer' format per record line")
-var sqlDatabasePath *string = flag.String("sql", "", "an sql database path to 'question, answer' records, with `path` and mapped `URL` in table columns per record")
-
-// fileReader()
-//  * takes the pointer to the opened file
-//	* dereferences the pointer to get the value i.e. *f
-//  * use ioutil to read the file and return data as []bytes
-//  * returns the function call as []bytes
-func fileReader(f *string) []byte {
-	data, err := ioutil.ReadFile(*f)
-	errMsgHandler(fmt.Sprintf("Failed to read file: %s\n", *f), err)
-	return data
-}
+var sqlDatabasePath *string = flag.String("sql", "", "a Postgres data source name, as a `postgres://` URL or libpq key/value pairs, of the `paths` table with `path` and mapped `URL` columns per record")
+var sqlPasswordFile *string = flag.String("sql-password-file", "", "a file holding the password of the -sql database; without any password, PGPASSWORD then ~/.pgpass are used")
+var sqlSSLMode *string = flag.String("sql-sslmode", "", "the sslmode of the -sql database connection (disable, require, verify-ca or verify-full), overriding the data source name")
+var sqlSSLRootCert *string = flag.String("sql-sslrootcert", "", "the CA certificate file that verifies the -sql database server")
+var sqlSSLCert *string = flag.String("sql-sslcert", "", "the client certificate file presented to the -sql database server")
+var sqlSSLKey *string = flag.String("sql-sslkey", "", "the key file of the -sql-sslcert client certificate")
+var sqlListenChannel *string = flag.String("sql-listen", "", "a Postgres notification channel; when set, the sql paths are served from memory and kept current through LISTEN/NOTIFY")
+var sqlInstallTrigger *bool = flag.Bool("sql-install-trigger", false, "create or replace the trigger on the `paths` table that notifies the -sql-listen channel")
+var sourceOrder *string = flag.String("order", "yaml,json,sql", "comma separated priority of the yaml, json and sql sources; a path in an earlier source wins")
+var writeSource *string = flag.String("write-source", "", "the source (yaml, json, sql or inline) that links created through /api/links are written to, defaults to the first source in -order")
+var codeLength *int = flag.Int("code-length", 6, "the number of characters in a generated short code")
+var codeAlphabet *string = flag.String("code-alphabet", gUS.Base62Alphabet, "the characters a generated short code is drawn from")
+var defaultStatus *int = flag.Int("default-status", http.StatusFound, "the redirect status of links that do not set their own (301, 302, 303, 307 or 308)")
+var defaultQuery *string = flag.String("default-query", string(gUS.QueryDrop), "what happens to the query string of links that do not set their own policy (drop, append, merge_incoming or merge_destination)")
+var expiredURL *string = flag.String("expired-url", "", "a url that links outside their not_before and expires_at window redirect to, instead of the 410 Gone page")
+var exhaustedURL *string = flag.String("exhausted-url", "", "a url that links with no clicks_left redirect to, instead of the 410 Gone page")
+var sweepInterval *time.Duration = flag.Duration("sweep-interval", time.Hour, "how often expired links are removed from their source, 0 disables sweeping")
+var sweepAfter *time.Duration = flag.Duration("sweep-after", 24*time.Hour, "how long an expired link keeps answering with the expired page before it is swept")
+var sweepArchive *string = flag.String("sweep-archive", "", "a file that swept links are appended to, one json object per line, instead of being discarded")
+var cookieKey *string = flag.String("cookie-key", "", "the secret that signs the cookie of visitors who entered a link's password, a random key per run when empty")
+var cookieTTL *time.Duration = flag.Duration("cookie-ttl", gUS.DefaultPasswordCookieTTL, "how long a visitor who entered a link's password is not asked for it again")
+var hashPassword *bool = flag.Bool("hash-password", false, "read a password from stdin, print its password_hash for a yaml or json mapping, and exit")
+var clicksFile *string = flag.String("clicks-file", "", "a file that a click event is appended to for every redirect, one json object per line")
+var clicksSQL *bool = flag.Bool("clicks-sql", false, "write a click event for every redirect to the `clicks` table of the -sql database")
+var clicksBuffer *int = flag.Int("clicks-buffer", gUS.DefaultClickBuffer, "how many click events are held while waiting to be written, further events are dropped")
+var clicksBatch *int = flag.Int("clicks-batch", gUS.DefaultClickBatch, "how many click events are written at once")
+var clicksFlushInterval *time.Duration = flag.Duration("clicks-flush-interval", gUS.DefaultClickFlushInterval, "how long a click event waits for its batch to fill up before it is written")
+var statsInterval *time.Duration = flag.Duration("stats-interval", time.Minute, "how often recorded clicks are rolled up for /api/links/{path}?view=stats, 0 disables the stats")
+var logLevel *string = flag.String("log-level", "info", "the lowest level of access log line written (debug, info, warn or error), 4xx responses are logged at warn and 5xx at error")
+var logOutput *string = flag.String("log-output", "stderr", "where the access log and the server log are written: stderr, stdout or a file path")
+var urlSchemes *string = flag.String("url-schemes", "http,https", "comma separated schemes a destination url may use")
+var allowDomains *string = flag.String("allow-domains", "", "comma separated domains, and their subdomains, that destination urls must point at; any domain when empty")
+var denyDomains *string = flag.String("deny-domains", "", "comma separated domains, and their subdomains, that destination urls may never point at")
+var invalidURLs *string = flag.String("invalid-urls", "reject", "what happens to a yaml, json or sql mapping whose url breaks the url policy: reject refuses the whole source, skip logs and ignores the mapping")
+var validateOnly *bool = flag.Bool("validate", false, "check the sources for invalid, duplicate, shadowing and cycling mappings, print what was found, and exit")
+var selfHosts *string = flag.String("self-hosts", "", "comma separated hosts this server answers on besides those in the -hosts file, a destination on them is followed to find redirect cycles")
+var reloadInterval *time.Duration = flag.Duration("reload-interval", 5*time.Second, "how often the yaml or json file is checked for changes, 0 disables polling (SIGHUP still reloads)")
 
 // sqlFlagReader()
-//  * takes the pointer to the sql database path provided by the user in the format:
-//			- `<protocol>://<host>:<port>/<database>?dbUser=<dbUserValue>&dbUserPassword=<dbUserPasswordValue>`
-//	* dereferences the pointer to get the value i.e. *f
-//	* uses regex to extract the following:
-//			- protocol
-//			- host
-//			- port
-//			- database i.e. dbname
-//			- databaseUser
-//			- databaseUserPassword
-//  * returns a `string` of database connection parameters required by sql.Open() based on the format below
-// 	 		- "user:password@tcp(localhost:port)/dbname" when using "mysql"
-// 			- "host=%s port=%d user=%s password=%s dbname=% sslmode=disable" when using "postgres"
+//  * takes the pointer to the sql data source name provided by the user, in any format gUS.ParseDSN() accepts:
+//			- a URL e.g. `postgres://<user>:<password>@<host>:<port>/<database>?sslmode=verify-full`
+//			- libpq key/value pairs e.g. `host=<host> port=<port> user=<user> dbname=<database>`
+//			- the older `<protocol>://<host>:<port>/<database>?dbUser=<dbUserValue>&dbUserPassword=<dbUserPasswordValue>`, which keeps `sslmode=disable`
+//	* adds the password read from `-sql-password-file`, and the `-sql-ssl*` settings, which win over those in the data source name
+//	* leaves a missing password to lib/pq, which then reads PGPASSWORD, then ~/.pgpass (or the PGPASSFILE file)
+//	* only ever prints the data source name with its password redacted
+//  * returns a `string` of key/value connection parameters, as required by sql.Open() and pq.NewListener()
 func sqlFlagReader(sqlDatabasePath *string) (dbConnParams string) {
-	u, err := url.Parse(*sqlDatabasePath)
-	errMsgHandler(fmt.Sprintf("Failed to parse the sql database path"), err)
-
-	fmt.Println(fmt.Sprintf("User's sql database path is: %s", u.String())) // echo back the user provided sql database path
-
-	host, portString, err := net.SplitHostPort(u.Host) // extract the url host and post by splitting it from the combined `Host`
-	errMsgHandler(fmt.Sprintf("Failed to extract host and port for sql database"), err)
-	port, _ := strconv.ParseUint(portString, 10, 32) // convert `port number` in string format, to integer format
-
-	database := strings.TrimLeft(u.Path, "/") // extract the database from the `Path` string, by removing the leading `/` character
-
-	queryString := u.RawQuery                          // get all the raw queries delimited by &
-	queryStringMap, err := url.ParseQuery(queryString) // convert queryString to a map datatype
-	errMsgHandler(fmt.Sprintf("Failed to parse the dbUser/dbUserPassword queryString"), err)
-	dbUser := queryStringMap["dbUser"][0]                 // extract database user from map i.e. first element of the slice for key `dbUser`
-	dbUserPassword := queryStringMap["dbUserPassword"][0] // extract database user password from map i.e. first element of the slice for key `dbUserPassword`
-
-	dbConnParams = fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", host, port, dbUser, dbUserPassword, database)
+	fmt.Printf("User's sql data source is: %s\n", gUS.RedactDSN(*sqlDatabasePath))
+	dbConnParams, err := gUS.ParseDSN(*sqlDatabasePath, gUS.DSNOptions{
+		PasswordFile: *sqlPasswordFile,
+		SSLMode:      *sqlSSLMode,
+		SSLRootCert:  *sqlSSLRootCert,
+		SSLCert:      *sqlSSLCert,
+		SSLKey:       *sqlSSLKey,
+	})
+	errMsgHandler(fmt.Sprintf("Invalid -sql data source:"), err)
 	return dbConnParams
 }
 
-// dbQuery()
-//	* takes the pointer to the sql database path
-//	* uses the sqlFlagReader() to extract database connection parameters, using the sql database path
-//  * reads the records from the SQL database
-//  * returns the data as a []byte
-func dbQuery(sqlDatabasePath *string) []gUS.PathURL {
-	dbConnParams := sqlFlagReader(sqlDatabasePath)
-	db := dbConnect(dbConnParams) // initiate connection to the database
-	defer db.Close()              //
-
-	// query for multiple records from database
-	var pathUrls gUS.PathURL                    // declare pathUrls struct, meant to read database data into
-	var pathUrlsSlice []gUS.PathURL             // declare slice of pathUrls, i.e. of aggregations of read database data
-	sqlStatement := `select * from paths`       // get all columns from all records, in table `paths`
-	multipleRows, err := db.Query(sqlStatement) // execute the sql
-	errMsgHandler(fmt.Sprintf("Failed to query the database"), err)
-
-	defer multipleRows.Close() // needed in case this did not go well
-
-	for multipleRows.Next() { // start iterating over the returned rows i.e.
-		err = multipleRows.Scan(&pathUrls.Path, &pathUrls.URL)
-		errMsgHandler(fmt.Sprintf("Failed to store sql data inside query the database"), err)
-		pathUrlsSlice = append(pathUrlsSlice, pathUrls) // append the newly scanned user to the existing slice of Users
-	}
-
-	err = multipleRows.Err() // handle the error thrown when `multipleRows.Next() returns a false`
-	errMsgHandler(fmt.Sprintf("multipleRows.Next() returned a false"), err)
-
-	return pathUrlsSlice // return by aggregated data
-}
-
 // dbConnect()
-// * connects to the database
-// * adds the connection to a poll
-// * pings the opened connection to ensure that it is still working
+// * connects to the database with gUS.OpenPostgres(), which sizes the pool and pings the database
 // * returns a db connection
-// * not that `defer db.close()` is not called here since it makes more sense to do that where dbConnect() is called
+// * not that `defer db.close()` is not called here since the connection is closed by serve() on shutdown
 func dbConnect(dbConnParams string) *sql.DB {
-	db, err := sql.Open("postgres", dbConnParams) // this opens a connection and adds to the pool
-	errMsgHandler(fmt.Sprintf("Failed to connect to the database"), err)
-
-	// connect to the database
-	err = db.Ping() // this validates that the opened connection "db" is actually working
-	errMsgHandler(fmt.Sprintf("The database connection is no longer open"), err)
-
+	db, err := gUS.OpenPostgres(dbConnParams)
+	errMsgHandler(fmt.Sprintf("Failed to connect to the database:"), err)
 	fmt.Println("Successfully connected to the database")
 	return db
 }
 
-// multiFlagTester()
-//  * checks to see if the user is trying to use multiple file formats (yaml, json, sql) at the same time
-//  * check to set number of flags `n` that have been set
-//	* throws an error message, if `n` > 1
-//  * returns a true boolean, if `n` > 1
-func multiFlagTester() bool {
-	numFlag := flag.NFlag()
-	if numFlag > 1 {
-		return true
-	}
-	return false
+// yamlFlagStore()
+//  * loads the yaml file into a YAML backed store, checking its urls against policy
+//  * keeps the store current with watchFileStore()
+func yamlFlagStore(yamlFilename *string, policy gUS.URLPolicy) gUS.Store {
+	yamlStore, err := gUS.NewYAMLStore(*yamlFilename, policy)
+	errMsgHandler(fmt.Sprintf("Failed to load the YAML"), err)
+	watchFileStore(yamlStore)
+	return yamlStore
 }
 
-// yamlFlagHandler()
-func yamlFlagHandler(yamlFilename *string, mapHandler http.HandlerFunc) http.HandlerFunc {
-	yamlHandler, err := gUS.YAMLHandler(fileReader(yamlFilename), mapHandler)
-	errMsgHandler(fmt.Sprintf("Failed to parse the YAML"), err)
-	return yamlHandler
+// jsonFlagStore()
+//  * loads the json file into a JSON backed store, checking its urls against policy
+//  * keeps the store current with watchFileStore()
+func jsonFlagStore(jsonFilename *string, policy gUS.URLPolicy) gUS.Store {
+	jsonStore, err := gUS.NewJSONStore(*jsonFilename, policy)
+	errMsgHandler(fmt.Sprintf("Failed to load the JSON"), err)
+	watchFileStore(jsonStore)
+	return jsonStore
 }
 
-// jsonFlagHandler()
-func jsonFlagHandler(jsonFilename *string, mapHandler http.HandlerFunc) http.HandlerFunc {
-	jsonHandler, err := gUS.JSONHandler(fileReader(jsonFilename), mapHandler)
-	errMsgHandler(fmt.Sprintf("Failed to parse the JSON"), err)
-	return jsonHandler
-}
+// watchFileStore()
+//  * reloads the file store whenever its file changes on disk, checking every `-reload-interval`
+//  * reloads the file store whenever the process receives a SIGHUP
+//  * a reload that fails keeps the last good mappings, and logs the error
+func watchFileStore(fs *gUS.FileStore) {
+	if *reloadInterval > 0 {
+		go fs.Watch(*reloadInterval, stop)
+	}
 
-// sqlFlagHandler()
-func sqlFlagHandler(sqlDatabasePath *string, mapHandler http.HandlerFunc) http.HandlerFunc {
-	sqlHandler, err := gUS.SQLHandler(dbQuery(sqlDatabasePath), mapHandler)
-	errMsgHandler(fmt.Sprintf("Failed to read from database"), err)
-	return sqlHandler
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := fs.Load(); err != nil {
+				log.Printf("Keeping the last good mappings for %s: %v", fs.Filename(), err)
+				continue
+			}
+			log.Printf("Reloaded the mappings from %s on SIGHUP", fs.Filename())
+		}
+	}()
 }
 
-// formatHandler()
-// * validates to avoid multiple flags being used simultaneously
-// * checks for which flag is being used
-// * leverages the appropriate flag handler
-// * defaults to using yaml flag when no flag is chosen
-func selectFlagHandler(mapHandler http.HandlerFunc) http.HandlerFunc {
-	if multiFlagTester() { // check if multiple flags are being used i.e. multiFlagTester returns a true or false boolean
-		errMsgHandler(fmt.Sprintf("Cannot use multiple flags at once. Please choose only yaml or json or sql \n"), nil)
+// sqlDB is the database handle shared by the sql source and the sql click sink, opened by sqlFlagDB()
+var sqlDB *sql.DB
+var sqlDBConnParams string
+
+// sqlFlagDB()
+//	* uses the sqlFlagReader() to extract database connection parameters, using the sql database path
+//  * opens a database handle that stays open for the lifetime of the server, on the first call only
+//  * returns the handle, and the connection parameters for connections that cannot come from the pool
+func sqlFlagDB(sqlDatabasePath *string) (*sql.DB, string) {
+	if sqlDB == nil {
+		sqlDBConnParams = sqlFlagReader(sqlDatabasePath)
+		sqlDB = dbConnect(sqlDBConnParams) // initiate connection to the database
 	}
+	return sqlDB, sqlDBConnParams
+}
 
-	if flag.NFlag() != 0 && !reflect.DeepEqual(*jsonFilename, "") { // if json filename is used THEN yaml/sql flag would be empty string
-		jsonHandler := jsonFlagHandler(jsonFilename, mapHandler)
-		fmt.Printf("Now using the JSON flag with the file: %s\n", *jsonFilename)
-		return jsonHandler
+// sqlFlagStore()
+//  * uses the database handle from sqlFlagDB()
+//  * returns a Postgres backed store i.e. one single-row lookup per request
+//  * or, when `-sql-listen` is set, a store that serves the paths from memory and applies changes announced on that channel
+//  * either checks the urls it reads against policy
+func sqlFlagStore(sqlDatabasePath *string, policy gUS.URLPolicy) gUS.Store {
+	db, dbConnParams := sqlFlagDB(sqlDatabasePath)
+
+	if *sqlListenChannel != "" {
+		if *sqlInstallTrigger {
+			errMsgHandler(fmt.Sprintf("Failed to install the notify trigger"), gUS.InstallNotifyTrigger(db, *sqlListenChannel))
+		}
+		notifyStore, err := gUS.NewNotifyStore(db, dbConnParams, *sqlListenChannel, policy)
+		errMsgHandler(fmt.Sprintf("Failed to load the paths from the database"), err)
+		go notifyStore.Listen(stop)
+		closers = append(closers, notifyStore)
+		fmt.Printf("Listening for path changes on channel: %s\n", *sqlListenChannel)
+		return notifyStore
 	}
 
-	if flag.NFlag() != 0 && !reflect.DeepEqual(*yamlFilename, "") { // if yaml filename is used THEN json/sql flags would be empty string
-		yamlHandler := yamlFlagHandler(yamlFilename, mapHandler)
-		return yamlHandler
+	sqlStore, err := gUS.NewPostgresStore(db, policy)
+	errMsgHandler(fmt.Sprintf("Failed to prepare the database queries"), err)
+	closers = append(closers, sqlStore)
+	return sqlStore
+}
+
+// selectFlagStore()
+// * checks for which source flags are being used
+// * leverages the appropriate flag store for each of them
+// * layers the stores in the `-order` priority, with the inline mappings as the lowest layer
+// * defaults to the `-default-yaml` file when no source flag is chosen
+// * checks the urls of every source against policy
+func selectFlagStore(inline gUS.Store, policy gUS.URLPolicy) *gUS.LayeredStore {
+	sourceFilenames := map[string]*string{"yaml": yamlFilename, "json": jsonFilename, "sql": sqlDatabasePath}
+	if *yamlFilename == "" && *jsonFilename == "" && *sqlDatabasePath == "" && *defaultYAML != "" {
+		*yamlFilename = *defaultYAML
+		fmt.Printf("No file flags was set. Defaulting to file: %s\n", *yamlFilename)
 	}
 
-	if flag.NFlag() != 0 && !reflect.DeepEqual(*sqlDatabasePath, "") { // if sql flag is used THEN yaml/json flags would be empty string
-		sqlHandler := sqlFlagHandler(sqlDatabasePath, mapHandler)
-		return sqlHandler
+	var layers []gUS.Layer
+	for _, name := range strings.Split(*sourceOrder, ",") {
+		name = strings.TrimSpace(name)
+		source, ok := sourceFilenames[name]
+		if !ok {
+			errMsgHandler(fmt.Sprintf("Unknown source in -order:"), errors.Errorf("%q, please choose from yaml, json and sql", name))
+		}
+		if *source == "" { // skip the sources whose flag was not set
+			continue
+		}
+		delete(sourceFilenames, name) // a source listed twice is only layered once
+		switch name {
+		case "yaml":
+			layers = append(layers, gUS.Layer{Name: "yaml", Store: yamlFlagStore(yamlFilename, policy)})
+		case "json":
+			layers = append(layers, gUS.Layer{Name: "json", Store: jsonFlagStore(jsonFilename, policy)})
+		case "sql":
+			layers = append(layers, gUS.Layer{Name: "sql", Store: sqlFlagStore(sqlDatabasePath, policy)})
+		}
+		fmt.Printf("Now using the %s source: %s\n", name, gUS.RedactDSN(*source))
+	}
+	for name, source := range sourceFilenames {
+		if *source != "" {
+			errMsgHandler(fmt.Sprintf("Source is set but missing from -order:"), errors.New(name))
+		}
 	}
 
-	// defaults to yamlHandler when no flags are selected i.e. 'flag.NFlag() returns 0'
-	*yamlFilename = "pathsData.yaml"
-	fmt.Printf("No file flags was set. Defaulting to file: %s\n", *yamlFilename)
-	yamlHandler := yamlFlagHandler(yamlFilename, mapHandler)
-	return yamlHandler
+	layers = append(layers, gUS.Layer{Name: "inline", Store: inline})
+	store := gUS.NewLayeredStore(layers...)
+	if *writeSource != "" {
+		errMsgHandler(fmt.Sprintf("Failed to select the -write-source"), store.SetWriteLayer(*writeSource))
+	}
+	return store
 }
 
 // urlShortenerHomepage handler
@@ -235,34 +275,260 @@ func custom404PageHandler(w http.ResponseWriter, r *http.Request, status int) {
 	}
 }
 
+// goneHandler()
+//  * redirects the links that can no longer redirect to their own destination to redirectURL, when it is set
+//  * otherwise serves a 410 page with the given content
+func goneHandler(redirectURL *string, dataGonePage string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *redirectURL != "" {
+			http.Redirect(w, r, *redirectURL, http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html") // set the content header type
+		w.WriteHeader(http.StatusGone)
+		io.WriteString(w, dataGonePage)
+	}
+}
+
+// printPasswordHash()
+//  * reads a password from the first line of r
+//  * prints its salted hash, ready to paste as the `password_hash` of a mapping
+func printPasswordHash(r io.Reader) {
+	password, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		errMsgHandler(fmt.Sprintf("Failed to read the password"), err)
+	}
+	passwordHash, err := gUS.HashPassword(strings.TrimRight(password, "\r\n"))
+	errMsgHandler(fmt.Sprintf("Failed to hash the password"), err)
+	fmt.Println(passwordHash)
+}
+
+// clickRecorder()
+//  * records the clicks to the `clicks` table when `-clicks-sql` is set, or else to `-clicks-file` when it is set
+//  * writes them in batches in the background
+//  * rolls them up for the stats of linksAPI every `-stats-interval`, in the rollup tables or in memory respectively
+//  * keeps the in-memory rollups in `<-clicks-file>.rollups`, so a restart resumes rather than replaying the whole file
+//  * returns nil when clicks are not recorded
+func clickRecorder(linksAPI *gUS.LinksAPI) *gUS.ClickRecorder {
+	var sink gUS.ClickSink
+	var source gUS.ClickSource
+	var rollups gUS.Rollups
+	switch {
+	case *clicksSQL:
+		if *sqlDatabasePath == "" {
+			errMsgHandler(fmt.Sprintf("Failed to record clicks:"), errors.New("-clicks-sql needs the -sql database"))
+		}
+		db, _ := sqlFlagDB(sqlDatabasePath)
+		sqlSink := gUS.NewPostgresClickSink(db)
+		sink, source, rollups = sqlSink, sqlSink, gUS.NewPostgresRollups(db)
+		fmt.Println("Recording clicks to the clicks table")
+	case *clicksFile != "":
+		fileSink := gUS.NewFileClickSink(*clicksFile)
+		memoryRollups, err := gUS.LoadMemoryRollups(*clicksFile + ".rollups")
+		errMsgHandler(fmt.Sprintf("Failed to load the rollups of the clicks file: %s\n", *clicksFile), err)
+		sink, source, rollups = fileSink, fileSink, memoryRollups
+		fmt.Printf("Recording clicks to file: %s\n", *clicksFile)
+	default:
+		return nil
+	}
+	recorder := gUS.NewClickRecorder(sink, *clicksBuffer, *clicksBatch, *clicksFlushInterval)
+	go recorder.Run(stop)
+
+	if *statsInterval > 0 {
+		go gUS.NewAggregator(source, rollups, gUS.DefaultAggregateBatch).Run(*statsInterval, stop)
+		linksAPI.SetStats(rollups)
+	}
+	return recorder
+}
+
+// accessLogger()
+//  * opens the `-log-output` destination, appending when it is a file
+//  * sends the server log there too, so every log line ends up in one place, from the first source loaded on
+//  * returns a logger of the requests at or above `-log-level`
+func accessLogger() *gUS.AccessLogger {
+	level, err := gUS.ParseLogLevel(*logLevel)
+	errMsgHandler(fmt.Sprintf("Invalid -log-level"), err)
+
+	var out io.Writer
+	switch *logOutput {
+	case "stderr", "":
+		out = os.Stderr
+	case "stdout":
+		out = os.Stdout
+	default:
+		out, err = os.OpenFile(*logOutput, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		errMsgHandler(fmt.Sprintf("Failed to open the -log-output file: %s\n", *logOutput), err)
+	}
+	log.SetOutput(out)
+	return gUS.NewAccessLogger(out, level)
+}
+
+// urlPolicy()
+//  * builds the url policy from `-url-schemes`, `-allow-domains`, `-deny-domains` and `-invalid-urls`
+//  * returns it for every source, the links API and validateSources() to check their urls against
+func urlPolicy() gUS.URLPolicy {
+	split := func(list string) []string {
+		var items []string
+		for _, item := range strings.Split(list, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return items
+	}
+	return gUS.URLPolicy{
+		Schemes:      split(*urlSchemes),
+		AllowDomains: split(*allowDomains),
+		DenyDomains:  split(*denyDomains),
+		SkipInvalid:  *invalidURLs == "skip",
+	}
+}
+
+// sweepExpired()
+//  * removes the links that expired more than `-sweep-after` ago from every source, every `-sweep-interval`
+//  * appends them to `-sweep-archive` first, when it is set
+func sweepExpired(store gUS.Store) {
+	if *sweepInterval <= 0 {
+		return
+	}
+	var archive func([]gUS.PathURL) error
+	if *sweepArchive != "" {
+		archive = gUS.FileArchive(*sweepArchive)
+	}
+	go gUS.Sweep(store, *sweepInterval, *sweepAfter, archive, stop)
+}
+
+// reservedPaths lists the paths that defaultMux() and the health checks answer, which a mapping would shadow
+var reservedPaths = []string{"/", gUS.HealthzPath, gUS.ReadyzPath}
+
+// validateSources()
+//  * checks every source for invalid, duplicate, shadowing and cycling mappings
+//  * leaves out the sql source unless `-validate` is set, since reading the whole `paths` table on every start does not scale
+//  * follows destinations on the hosts of the `-hosts` file and `-self-hosts`
+//  * checks the urls against policy, as the sources do
+//  * prints each problem as a warning, or, with `-validate`, prints them all and exits, with status 1 when there is any
+func validateSources(store *gUS.LayeredStore, hosts []hostConfig, policy gUS.URLPolicy) {
+	opts := gUS.ValidateOptions{Reserved: reservedPaths, URLPolicy: policy}
+	for _, hc := range hosts {
+		opts.Hosts = append(opts.Hosts, hc.Host)
+	}
+	for _, host := range strings.Split(*selfHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			opts.Hosts = append(opts.Hosts, host)
+		}
+	}
+	checked := store
+	if !*validateOnly {
+		var layers []gUS.Layer
+		for _, l := range store.Layers() {
+			if l.Name != "sql" {
+				layers = append(layers, l)
+			}
+		}
+		checked = gUS.NewLayeredStore(layers...)
+	}
+	problems, err := gUS.Validate(checked, opts)
+	errMsgHandler(fmt.Sprintf("Failed to validate the sources"), err)
+
+	for _, p := range problems {
+		fmt.Printf("Warning: %s\n", p)
+	}
+	if !*validateOnly {
+		return
+	}
+	fmt.Printf("Found %d problem(s)\n", len(problems))
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
 // defaultMux defines the router Mux that:
 //   * initializes a new Mux
 //   * maps routes to handlers
-func defaultMux() *http.ServeMux {
+//   * serves the homepage on `/`
+//   * leaves the links API, `/debug/sources` and `/metrics` to adminMux(), so no short link host can read or change the links, or read the server's internals
+func defaultMux(homePage http.HandlerFunc) *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", urlShortenerHomePage)
+	mux.HandleFunc("/", homePage)
 	return mux
 }
 
+// adminMux defines the router Mux of the `-admin-listen` address that:
+//   * serves the links API on `/api/links`
+//   * reports which source resolves each path on `/debug/sources`
+//   * serves the Prometheus metrics on `/metrics`
+//   * answers only the requests carrying the `-admin-token`, when it is set
+func adminMux(store *gUS.LayeredStore, linksAPI, metrics http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/api/links", linksAPI)
+	mux.Handle("/api/links/", linksAPI)
+	mux.HandleFunc("/debug/sources", gUS.DebugHandler(store))
+	mux.Handle("/metrics", metrics)
+	return gUS.RequireToken(*adminToken, mux)
+}
+
 // define main function that:
-//   * uses defaultMux()
-//   * uses mapHandler from `goURlShortner` package
-//   * uses yamlHandler from `goURlShortner` package
-//   * uses jsonHandler from `goURlShortner` package
+//   * reads its settings from the command line, the environment and the `-config` file with loadConfig(), or prints them with `config check`
+//   * layers the inline mappings and the flag sources with selectFlagStore(), then checks them with validateSources()
+//   * uses storeHandler from `goURlShortner` package
+//   * uses defaultMux() as the fallback, or the host's own mux for each host in the `-hosts` file
+//   * serves the links API, `/debug/sources` and `/metrics` with adminMux() on `-admin-listen`, apart from the short links
+//   * sweeps the expired links in the background with sweepExpired()
+//   * logs every request with accessLogger(), apart from the health checks on `/healthz` and `/readyz`
+//   * serves until SIGINT or SIGTERM, then shuts down gracefully with serve()
 func main() {
-	// initialize all flags
-	flag.Parse()
-
-	// create an instance of defaultMux()
-	mux := defaultMux()
+	// `config check` prints the effective configuration instead of starting the server
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "check" {
+		cfg := loadConfig(os.Args[3:])
+		checkConfig()
+		inlineMappings(cfg, urlPolicy())
+		printConfig(cfg)
+		return
+	}
 
-	// Build the MapHandler using the mux as the fallback
-	pathsToUrls := map[string]string{
-		"/urlshort-godoc": "https://godoc.org/github.com/gophercises/urlshort",
-		"/yaml-godoc":     "https://godoc.org/gopkg.in/yaml.v2",
+	// initialize all flags, from the command line, the environment and the config file
+	cfg := loadConfig(os.Args[1:])
+	checkConfig()
+	if *hashPassword {
+		printPasswordHash(os.Stdin)
+		return
+	}
+	// open the log output before any source, so what the sources log while loading ends up there too
+	logger := accessLogger()
+	policy := urlPolicy()
+
+	// layer the inline mappings, that every other source can override, below the flag sources
+	store := selectFlagStore(gUS.NewMemoryStore(inlineMappings(cfg, policy)), policy)
+	hosts := hostsFileReader(hostsFilename, policy)
+	validateSources(store, hosts, policy)
+	sweepExpired(store)
+
+	// create an instance of defaultMux(), and the links API and metrics served apart by adminMux()
+	linksAPI := gUS.NewLinksAPI(store, gUS.CodeGenerator{Alphabet: *codeAlphabet, Length: *codeLength}, policy)
+	clicks := clickRecorder(linksAPI)
+	metrics := gUS.MetricsHandler(gUS.MetricsSources{Store: store, DB: sqlDB, Clicks: clicks})
+	mux := defaultMux(urlShortenerHomePage)
+
+	storeHandler := &gUS.Redirector{
+		Store:         store,
+		Fallback:      mux,
+		HostFallbacks: hostFallbacks(hosts),
+		DefaultStatus: *defaultStatus,
+		DefaultQuery:  gUS.QueryPolicy(*defaultQuery),
+		Expired:       goneHandler(expiredURL, "This link has expired, or is not active yet ... 410!"),
+		Exhausted:     goneHandler(exhaustedURL, "This link has been used up ... 410!"),
+		CookieKey:     []byte(*cookieKey),
+		CookieTTL:     *cookieTTL,
+		Clicks:        clicks,
 	}
-	mapHandler := gUS.MapHandler(pathsToUrls, mux)
 	fmt.Println("\n==== ==== ==== ====")
-	fmt.Println("Starting the server on :8080")
-	log.Fatal(errors.Wrap(http.ListenAndServe(":8080", selectFlagHandler(mapHandler)), "Failed to start WebServer"))
+	fmt.Printf("Starting the server on %s\n", *listenAddr)
+	var admin http.Handler
+	if *adminListen != "" {
+		fmt.Printf("Serving the links API and the metrics on %s\n", *adminListen)
+		admin = logger.Handler(adminMux(store, linksAPI, metrics))
+	}
+	health := gUS.HealthSources{Store: store, DB: sqlDB}
+	serve(gUS.HealthHandler(health, logger.Handler(storeHandler)), admin, clicks)
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	gUS "github.com/damilarelana/goUrlShortener"
+)
+
+// define flags
+var readTimeout *time.Duration = flag.Duration("read-timeout", 10*time.Second, "how long the server waits to read a whole request, headers and body")
+var writeTimeout *time.Duration = flag.Duration("write-timeout", 30*time.Second, "how long the server may take to write a response, counted from the end of the request headers")
+var idleTimeout *time.Duration = flag.Duration("idle-timeout", 2*time.Minute, "how long a keep-alive connection is kept open without a request")
+var shutdownTimeout *time.Duration = flag.Duration("shutdown-timeout", 20*time.Second, "how long a shutdown on SIGINT or SIGTERM waits for in-flight requests, then for the click events to be written")
+
+// stop is closed once the server has shut down, stopping every background loop started with it
+var stop = make(chan struct{})
+
+// closers are closed, in order, once the background loops have stopped, before the database itself
+var closers []io.Closer
+
+// serve()
+//  * serves handler on `-listen`, and admin on `-admin-listen` unless admin is nil
+//  * with the `-read-timeout`, `-write-timeout` and `-idle-timeout`
+//  * on SIGINT or SIGTERM, stops accepting connections, and waits up to `-shutdown-timeout` for the in-flight requests
+//  * then stops the background loops, waits within the same deadline for clicks to write its buffered events
+//  * and closes the closers, then the database
+//  * exits with status 1 when a server fails, or the deadline passes
+func serve(handler, admin http.Handler, clicks *gUS.ClickRecorder) {
+	servers := []*http.Server{newServer(*listenAddr, handler)}
+	if admin != nil {
+		servers = append(servers, newServer(*adminListen, admin))
+	}
+
+	failed := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				failed <- err
+			}
+		}(server)
+	}
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-failed:
+		errMsgHandler(fmt.Sprintf("Failed to start WebServer"), err)
+	case sig := <-term:
+		log.Printf("Shutting down on %s, waiting up to %s for in-flight requests", sig, *shutdownTimeout)
+	}
+	signal.Stop(term) // a second signal kills the process as usual
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	clean := true
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Gave up on the in-flight requests of %s: %v", server.Addr, err)
+			clean = false
+		}
+	}
+
+	close(stop)
+	if clicks != nil {
+		select {
+		case <-clicks.Done():
+		case <-ctx.Done():
+			log.Printf("Gave up writing the buffered click events: %v", ctx.Err())
+			clean = false
+		}
+	}
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			log.Printf("Failed to close: %v", err)
+		}
+	}
+	if sqlDB != nil {
+		if err := sqlDB.Close(); err != nil {
+			log.Printf("Failed to close the database: %v", err)
+		}
+	}
+
+	if !clean {
+		os.Exit(1)
+	}
+	log.Println("Shut down cleanly")
+}
+
+// newServer()
+//  * returns a server of handler on addr, with the `-read-timeout`, `-write-timeout` and `-idle-timeout`
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: *writeTimeout,
+		IdleTimeout:  *idleTimeout,
+	}
+}
+
+// isLoopback()
+//  * reports whether addr only listens on the loopback interface e.g. `localhost:8081` or `127.0.0.1:8081`
+//  * an address without a host, e.g. `:8081`, listens on every interface
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
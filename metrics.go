@@ -0,0 +1,320 @@
+package goUrlShortener
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// define the results a request served by a Redirector is counted under
+// * resultHit redirected, resultMiss fell through to a fallback handler
+// * resultExpired and resultExhausted served the expired and exhausted pages
+// * resultPassword asked for a password, or refused a wrong one, resultError failed
+const (
+	resultHit       = "hit"
+	resultMiss      = "miss"
+	resultExpired   = "expired"
+	resultExhausted = "exhausted"
+	resultPassword  = "password"
+	resultError     = "error"
+)
+
+// requestDurationBuckets are the upper bounds, in seconds, of the request latency histogram buckets
+var requestDurationBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// the metrics collected by the package, shared by every Redirector and store in the process
+var (
+	requestsTotal   = newCounterVec("urlshort_requests_total", "Requests served by the redirect handler, by result.", "result")
+	requestDuration = newHistogramVec("urlshort_request_duration_seconds", "Latency of the redirect handler, by result.", requestDurationBuckets, "result")
+	reloadsTotal    = newCounterVec("urlshort_reloads_total", "Reloads of the mappings of a store, by store and result.", "store", "result")
+)
+
+// countReload counts a reload of store as a failure when err is set, as a success when the mappings changed
+func countReload(store string, changed bool, err error) {
+	switch {
+	case err != nil:
+		reloadsTotal.add(1, store, "failure")
+	case changed:
+		reloadsTotal.add(1, store, "success")
+	}
+}
+
+// counterVec is a Prometheus counter with labels, safe for concurrent use
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64 // keyed by the formatted label pairs
+}
+
+// newCounterVec returns a counterVec with the given label names
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// add adds v to the counter for the label values, given in the order of the label names
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+// write writes the counter in the text exposition format
+func (c *counterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+// histogramVec is a Prometheus histogram with labels, safe for concurrent use
+type histogramVec struct {
+	name, help string
+	buckets    []float64
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]*histogram // keyed by the formatted label pairs
+}
+
+// histogram holds the observations of a single set of label values
+//  * counts[i] counts the observations that fell in bucket i alone, they are summed up when written
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// newHistogramVec returns a histogramVec with the given bucket upper bounds and label names
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, buckets: buckets, labels: labels, values: make(map[string]*histogram)}
+}
+
+// observe records v in the histogram for the label values, given in the order of the label names
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := formatLabels(h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.count++
+	hist.sum += v
+}
+
+// write writes the histogram in the text exposition format, with cumulative buckets
+func (h *histogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.values[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, hist.count)
+	}
+}
+
+// MetricsSources lists what MetricsHandler reports on, besides the metrics the package collects itself
+//  * Store reports its mapping count per layer, when it is a LayeredStore, or as a whole otherwise
+//  * DB reports its connection pool stats, when it is not nil
+//  * Clicks reports its dropped and failed events, when it is not nil
+type MetricsSources struct {
+	Store  Store
+	DB     *sql.DB
+	Clicks *ClickRecorder
+}
+
+// MetricsHandler serves every metric in the Prometheus text exposition format, for `/metrics`
+//  * the mapping counts and pool stats are read at scrape time, so they are always current
+func MetricsHandler(sources MetricsSources) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		requestsTotal.write(bw)
+		requestDuration.write(bw)
+		reloadsTotal.write(bw)
+		if sources.Store != nil {
+			writeMappingCounts(bw, sources.Store)
+		}
+		if sources.DB != nil {
+			writeDBStats(bw, sources.DB.Stats())
+		}
+		if sources.Clicks != nil {
+			writeHeader(bw, "urlshort_click_events_dropped_total", "Click events dropped because the buffer was full.", "counter")
+			fmt.Fprintf(bw, "urlshort_click_events_dropped_total %d\n", sources.Clicks.Dropped())
+			writeHeader(bw, "urlshort_click_events_failed_total", "Click events lost because their batch failed to write.", "counter")
+			fmt.Fprintf(bw, "urlshort_click_events_failed_total %d\n", sources.Clicks.Failed())
+		}
+		if err := bw.Flush(); err != nil {
+			log.Printf("Failed to write metrics: %v", err)
+		}
+	}
+}
+
+// Counter is implemented by Stores that can count their mappings without listing them
+//  * the count may be an estimate, for a Store too large to count on every scrape
+type Counter interface {
+	Count() (int, error)
+}
+
+// Count returns the number of mappings
+func (m *MemoryStore) Count() (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.pathsToUrls), nil
+}
+
+// Count estimates the rows of the `paths` table from the planner statistics, so that a scrape never scans the table
+//  * the estimate is the one of the last vacuum or analyze, or the live rows counted by the statistics collector before the first one
+func (ps *PostgresStore) Count() (int, error) {
+	var n int
+	err := ps.db.QueryRow(`select case when c.reltuples >= 0 then c.reltuples::bigint else coalesce(s.n_live_tup, 0) end
+		from pg_class c left join pg_stat_user_tables s on s.relid = c.oid where c.oid = 'paths'::regclass`).Scan(&n)
+	return n, dbError(err, "paths")
+}
+
+// countMappings counts the mappings of store, listing them when it does not implement Counter
+func countMappings(store Store) (int, error) {
+	if counter, ok := store.(Counter); ok {
+		return counter.Count()
+	}
+	pathUrls, err := store.List()
+	return len(pathUrls), err
+}
+
+// writeMappingCounts writes the number of mappings held by each layer of store
+//  * a layer that fails to count is logged and left out
+func writeMappingCounts(w *bufio.Writer, store Store) {
+	layers := []Layer{{Name: "store", Store: store}}
+	if ls, ok := store.(*LayeredStore); ok {
+		layers = ls.Layers()
+	}
+	writeHeader(w, "urlshort_mappings", "Mappings held by each source.", "gauge")
+	for _, l := range layers {
+		n, err := countMappings(l.Store)
+		if err != nil {
+			log.Printf("Failed to count the mappings of source %s: %v", l.Name, err)
+			continue
+		}
+		fmt.Fprintf(w, "urlshort_mappings%s %d\n", formatLabels([]string{"source"}, []string{l.Name}), n)
+	}
+}
+
+// writeDBStats writes the connection pool stats of the SQL backend
+func writeDBStats(w *bufio.Writer, stats sql.DBStats) {
+	gauges := []struct {
+		name, help string
+		value      float64
+	}{
+		{"urlshort_db_max_open_connections", "Maximum number of open connections to the database.", float64(stats.MaxOpenConnections)},
+		{"urlshort_db_open_connections", "Established connections, both in use and idle.", float64(stats.OpenConnections)},
+		{"urlshort_db_in_use_connections", "Connections currently in use.", float64(stats.InUse)},
+		{"urlshort_db_idle_connections", "Idle connections.", float64(stats.Idle)},
+	}
+	counters := []struct {
+		name, help string
+		value      float64
+	}{
+		{"urlshort_db_wait_count_total", "Connections waited for.", float64(stats.WaitCount)},
+		{"urlshort_db_wait_duration_seconds_total", "Time spent waiting for a connection.", stats.WaitDuration.Seconds()},
+		{"urlshort_db_max_idle_closed_total", "Connections closed due to the idle connection limit.", float64(stats.MaxIdleClosed)},
+		{"urlshort_db_max_idle_time_closed_total", "Connections closed due to the idle time limit.", float64(stats.MaxIdleTimeClosed)},
+		{"urlshort_db_max_lifetime_closed_total", "Connections closed due to the connection lifetime limit.", float64(stats.MaxLifetimeClosed)},
+	}
+	for _, g := range gauges {
+		writeHeader(w, g.name, g.help, "gauge")
+		fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.value))
+	}
+	for _, c := range counters {
+		writeHeader(w, c.name, c.help, "counter")
+		fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.value))
+	}
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// formatLabels formats label pairs as `{name="value",...}`, escaping the values, or "" when there are none
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + `="` + labelEscaper.Replace(value) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelEscaper escapes a label value as the text exposition format requires
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// withLabel adds one more label pair to formatted label pairs
+func withLabel(labels, name, value string) string {
+	pair := name + `="` + labelEscaper.Replace(value) + `"`
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return strings.TrimSuffix(labels, "}") + "," + pair + "}"
+}
+
+// formatFloat formats a sample value the way Prometheus does
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of values in order, so every scrape lists the series in the same order
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// observeRequest counts a request served by a Redirector, and records how long it took
+func observeRequest(result string, start time.Time) {
+	requestsTotal.add(1, result)
+	requestDuration.observe(time.Since(start).Seconds(), result)
+}
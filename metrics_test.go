@@ -0,0 +1,77 @@
+package goUrlShortener
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	counter := newCounterVec("test_total", "A counter.", "result", "path")
+	counter.add(1, "hit", "/a")
+	counter.add(2, "hit", "/a")
+	counter.add(1, "miss", `say "hi"\n`)
+	histogram := newHistogramVec("test_seconds", "A histogram.", []float64{0.1, 1}, "result")
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		histogram.observe(v, "hit")
+	}
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	counter.write(w)
+	histogram.write(w)
+	w.Flush()
+	want := `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{result="hit",path="/a"} 3
+test_total{result="miss",path="say \"hi\"\\n"} 1
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{result="hit",le="0.1"} 2
+test_seconds_bucket{result="hit",le="1"} 3
+test_seconds_bucket{result="hit",le="+Inf"} 4
+test_seconds_sum{result="hit"} 3.65
+test_seconds_count{result="hit"} 4
+`
+	if buf.String() != want {
+		t.Errorf("exposition =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+// sampleLine matches a sample line of the text exposition format
+var sampleLine = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*(\{[a-zA-Z_][a-zA-Z0-9_]*="(\\.|[^"\\])*"(,[a-zA-Z_][a-zA-Z0-9_]*="(\\.|[^"\\])*")*\})? [-+0-9.eInf]+$`)
+
+func TestMetricsHandler(t *testing.T) {
+	store := NewLayeredStore(
+		Layer{Name: "yaml", Store: NewMemoryStore([]PathURL{{Path: "/a", URL: "https://example.com"}, {Path: "/b", URL: "https://example.com"}})},
+		Layer{Name: "inline", Store: NewMemoryStore(nil)},
+	)
+	observeRequest(resultHit, time.Now())
+	w := httptest.NewRecorder()
+	MetricsHandler(MetricsSources{Store: store, Clicks: NewClickRecorder(&memoryClickSink{}, 1, 1, 0)})(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q, want the text exposition format", ct)
+	}
+	body := w.Body.String()
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if !strings.HasPrefix(line, "# HELP ") && !strings.HasPrefix(line, "# TYPE ") && !sampleLine.MatchString(line) {
+			t.Errorf("malformed line %q", line)
+		}
+	}
+	for _, sample := range []string{
+		`urlshort_mappings{source="yaml"} 2`,
+		`urlshort_mappings{source="inline"} 0`,
+		`urlshort_click_events_dropped_total 0`,
+		`urlshort_request_duration_seconds_bucket{result="hit",le="+Inf"}`,
+	} {
+		if !strings.Contains(body, "\n"+sample) {
+			t.Errorf("no %s in\n%s", sample, body)
+		}
+	}
+}
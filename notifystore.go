@@ -0,0 +1,242 @@
+package goUrlShortener
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// define how the LISTEN connection behaves when Postgres goes away
+// * pq retries the connection with a back-off between these two intervals
+// * the connection is pinged when no notification arrived for notifyPingInterval
+const (
+	notifyMinReconnectInterval = 1 * time.Second
+	notifyMaxReconnectInterval = 30 * time.Second
+	notifyPingInterval         = 90 * time.Second
+)
+
+// pathNotification declares the payload sent by the trigger installed with InstallNotifyTrigger
+//  * Op is one of `upsert`, `delete`, `clicks` or `reload`
+//  * ClicksLeft is only sent with `clicks`, for an UPDATE that changed nothing else
+type pathNotification struct {
+	Op         string `json:"op"`
+	Host       string `json:"host"`
+	Path       string `json:"path"`
+	ClicksLeft *int   `json:"clicks_left"`
+}
+
+// NotifyStore is a Store that serves the `paths` table of a Postgres database from memory
+//  * the whole table is loaded once, then kept current through LISTEN/NOTIFY
+//  * every notification names a single host and path, which is re-read and applied to the in-memory mappings
+//  * except a redirect taking a click off, whose notification carries the clicks left, so redirects cost no re-read
+//  * the whole table is re-loaded whenever the LISTEN connection is re-established, since notifications may have been missed
+//  * Put and Delete write to Postgres, and the in-memory mappings follow once the notification arrives
+//  * it also implements ReloadReporter, for the readiness check
+type NotifyStore struct {
+	*MemoryStore
+	reloadStatus
+	db       *PostgresStore
+	listener *pq.Listener
+	channel  string
+}
+
+// NewNotifyStore returns a NotifyStore for the `paths` table behind db
+//  * dbConnParams opens the dedicated LISTEN connection, so it must point at the same database as db
+//  * the channel is subscribed to before the table is loaded, so no change slips in between the two
+//  * every row read is checked against policy, as by PostgresStore
+//  * call Listen, in its own goroutine, to start applying notifications
+func NewNotifyStore(db *sql.DB, dbConnParams, channel string, policy URLPolicy) (*NotifyStore, error) {
+	ps, err := NewPostgresStore(db, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	listener := pq.NewListener(dbConnParams, notifyMinReconnectInterval, notifyMaxReconnectInterval, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("LISTEN connection on channel %s: %v", channel, err)
+		}
+	})
+	if err = listener.Listen(channel); err != nil {
+		listener.Close()
+		return nil, errors.Wrapf(&ConnectionError{Err: err}, "failed to listen on channel: %s", channel)
+	}
+
+	ns := &NotifyStore{
+		MemoryStore: NewMemoryStore(nil),
+		db:          ps,
+		listener:    listener,
+		channel:     channel,
+	}
+	if err = ns.reload(); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return ns, nil
+}
+
+// Listen applies notifications to the in-memory mappings as they arrive
+//  * until stop is closed, it also pings the connection every notifyPingInterval, so a dead connection is noticed on a quiet channel
+func (ns *NotifyStore) Listen(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case n := <-ns.listener.Notify:
+			if n == nil { // pq sends a nil notification once it has re-established a lost connection
+				if err := ns.reload(); err != nil {
+					log.Printf("Failed to reload paths after reconnecting to channel %s: %v", ns.channel, err)
+				}
+				continue
+			}
+			if err := ns.apply(n.Extra); err != nil {
+				log.Printf("Failed to apply notification %q on channel %s: %v", n.Extra, ns.channel, err)
+			}
+		case <-time.After(notifyPingInterval):
+			go ns.listener.Ping() // a failed ping makes pq reconnect, which then triggers a reload
+		}
+	}
+}
+
+// Close stops listening and releases the prepared statements, but leaves `db` open for its owner to close
+func (ns *NotifyStore) Close() error {
+	if err := ns.listener.Close(); err != nil {
+		return err
+	}
+	return ns.db.Close()
+}
+
+// Put writes the mapping for the host and path of pu to Postgres, and to memory without waiting for the notification
+func (ns *NotifyStore) Put(pu PathURL) error {
+	if err := ns.db.Put(pu); err != nil {
+		return err
+	}
+	return ns.MemoryStore.Put(pu)
+}
+
+// Delete removes the mapping for key from Postgres, and from memory without waiting for the notification
+func (ns *NotifyStore) Delete(key string) error {
+	if err := ns.db.Delete(key); err != nil {
+		return err
+	}
+	if err := ns.MemoryStore.Delete(key); err != nil && err != ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// Locate reads the whole `paths` table as written, rather than the in-memory mappings
+func (ns *NotifyStore) Locate() ([]SourceMapping, error) {
+	return ns.db.Locate()
+}
+
+// reload replaces the in-memory mappings with the whole `paths` table, counting it in the reload metrics and reporting it to the readiness check
+func (ns *NotifyStore) reload() error {
+	pathUrls, err := ns.db.List()
+	countReload("sql", err == nil, err)
+	ns.record(err == nil, err == nil, err)
+	if err != nil {
+		return err
+	}
+	ns.MemoryStore.Replace(pathUrls)
+	return nil
+}
+
+// apply decodes a notification payload and brings the named host and path up to date
+//  * the row is re-read rather than taken from the payload, which keeps payloads far below the 8000 byte NOTIFY limit
+//  * and means an `upsert` and a `delete` for the same host and path, in either order, both settle on the current row
+//  * a `clicks` notification sets the clicks left it carries instead, the rest of the row being unchanged
+func (ns *NotifyStore) apply(payload string) error {
+	var pn pathNotification
+	if err := json.Unmarshal([]byte(payload), &pn); err != nil {
+		return errors.Wrap(err, "failed to decode notification")
+	}
+	switch pn.Op {
+	case "reload":
+		return ns.reload()
+	case "clicks":
+		return ns.setClicks(pn.Host, pn.Path, pn.ClicksLeft)
+	}
+	return ns.refresh(pn.Host, pn.Path)
+}
+
+// setClicks sets the ClicksLeft of the in-memory mapping for host and path
+//  * a mapping missing from memory is re-read instead, as for an `upsert`
+func (ns *NotifyStore) setClicks(host, path string, clicksLeft *int) error {
+	pu, ok, err := ns.MemoryStore.Lookup(HostKey(host, path))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ns.refresh(host, path)
+	}
+	pu.ClicksLeft = clicksLeft
+	return ns.MemoryStore.Put(pu)
+}
+
+// refresh re-reads the row for host and path, and puts it in memory, or removes it from memory when the row is gone
+func (ns *NotifyStore) refresh(host, path string) error {
+	pu, ok, err := ns.db.lookupHostPath(host, path)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err = ns.MemoryStore.Delete(HostKey(host, path)); err != ErrNotFound {
+			return err
+		}
+		return nil
+	}
+	return ns.MemoryStore.Put(pu)
+}
+
+// notifyTriggerSQL declares the trigger that announces every change to the `paths` table on a channel
+//  * an UPDATE sends a single `upsert`, preceded by a `delete` for the old host and path only when they changed
+//  * an UPDATE of clicks_left alone, as every redirect of a limited link makes, sends a `clicks` with the new value
+//  * an UPDATE that changes nothing sends nothing
+//  * a TRUNCATE sends a single `reload`
+const notifyTriggerSQL = `
+create or replace function paths_notify() returns trigger as $$
+begin
+	if tg_op = 'TRUNCATE' then
+		perform pg_notify(%[1]s, json_build_object('op', 'reload')::text);
+		return null;
+	end if;
+	if tg_op = 'UPDATE' then
+		if to_jsonb(old) - 'clicks_left' = to_jsonb(new) - 'clicks_left' then
+			if old.clicks_left is distinct from new.clicks_left then
+				perform pg_notify(%[1]s, json_build_object('op', 'clicks', 'host', new.host, 'path', new.path, 'clicks_left', new.clicks_left)::text);
+			end if;
+			return null;
+		end if;
+		if (old.host, old.path) is distinct from (new.host, new.path) then
+			perform pg_notify(%[1]s, json_build_object('op', 'delete', 'host', old.host, 'path', old.path)::text);
+		end if;
+	end if;
+	if tg_op = 'DELETE' then
+		perform pg_notify(%[1]s, json_build_object('op', 'delete', 'host', old.host, 'path', old.path)::text);
+	end if;
+	if tg_op in ('INSERT', 'UPDATE') then
+		perform pg_notify(%[1]s, json_build_object('op', 'upsert', 'host', new.host, 'path', new.path)::text);
+	end if;
+	return null;
+end;
+$$ language plpgsql;
+
+drop trigger if exists paths_notify on paths;
+create trigger paths_notify after insert or update or delete on paths
+	for each row execute procedure paths_notify();
+
+drop trigger if exists paths_notify_truncate on paths;
+create trigger paths_notify_truncate after truncate on paths
+	for each statement execute procedure paths_notify();
+`
+
+// InstallNotifyTrigger creates, or replaces, the trigger on the `paths` table that NotifyStore listens for
+func InstallNotifyTrigger(db *sql.DB, channel string) error {
+	_, err := db.Exec(fmt.Sprintf(notifyTriggerSQL, pq.QuoteLiteral(channel)))
+	return errors.Wrapf(err, "failed to install the notify trigger for channel: %s", channel)
+}
@@ -0,0 +1,136 @@
+package goUrlShortener
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestNotifyStoreApplyClicks(t *testing.T) {
+	clicks := 5
+	ns := &NotifyStore{MemoryStore: NewMemoryStore([]PathURL{{Path: "/launch", URL: "https://example.com/launch", ClicksLeft: &clicks}})}
+
+	tests := []struct {
+		payload string
+		want    *int
+	}{
+		{`{"op": "clicks", "host": "", "path": "/launch", "clicks_left": 3}`, intPtr(3)},
+		{`{"op": "clicks", "host": "", "path": "/launch", "clicks_left": 0}`, intPtr(0)},
+		{`{"op": "clicks", "host": "", "path": "/launch", "clicks_left": null}`, nil},
+	}
+	for _, tt := range tests {
+		if err := ns.apply(tt.payload); err != nil {
+			t.Fatalf("apply(%s) failed: %v", tt.payload, err)
+		}
+		pu, _, _ := ns.Lookup("/launch")
+		if !equalIntPtr(pu.ClicksLeft, tt.want) || pu.URL != "https://example.com/launch" {
+			t.Errorf("apply(%s) left %s with %v clicks, want %v", tt.payload, pu.URL, pu.ClicksLeft, tt.want)
+		}
+	}
+}
+
+func TestNotifyStoreApply(t *testing.T) {
+	db := testPostgres(t, pathsTable)
+	ps, err := NewPostgresStore(db, URLPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	ns := &NotifyStore{MemoryStore: NewMemoryStore([]PathURL{{Path: "/stale", URL: "https://example.com/stale"}}), db: ps}
+
+	tests := []struct {
+		statement, payload string
+		want               map[string]string // url per key in memory afterwards
+	}{
+		{`insert into paths (path, url) values ('/a', 'https://example.com/a')`, `{"op": "upsert", "host": "", "path": "/a"}`,
+			map[string]string{"/stale": "https://example.com/stale", "/a": "https://example.com/a"}},
+		{`update paths set url = 'https://example.com/b' where path = '/a'`, `{"op": "upsert", "host": "", "path": "/a"}`,
+			map[string]string{"/stale": "https://example.com/stale", "/a": "https://example.com/b"}},
+		{`update paths set path = '/c' where path = '/a'`, `{"op": "delete", "host": "", "path": "/a"}`,
+			map[string]string{"/stale": "https://example.com/stale"}},
+		{``, `{"op": "upsert", "host": "", "path": "/c"}`,
+			map[string]string{"/stale": "https://example.com/stale", "/c": "https://example.com/b"}},
+		{``, `{"op": "delete", "host": "", "path": "/c"}`, // a delete arriving after a later upsert keeps the row
+			map[string]string{"/stale": "https://example.com/stale", "/c": "https://example.com/b"}},
+		{`insert into paths (host, path, url) values ('sho.rt', '/d', 'https://example.com/d')`, `{"op": "reload"}`,
+			map[string]string{"/c": "https://example.com/b", "sho.rt/d": "https://example.com/d"}},
+	}
+	for _, tt := range tests {
+		if tt.statement != "" {
+			if _, err = db.Exec(tt.statement); err != nil {
+				t.Fatalf("%s: %v", tt.statement, err)
+			}
+		}
+		if err = ns.apply(tt.payload); err != nil {
+			t.Fatalf("apply(%s) failed: %v", tt.payload, err)
+		}
+		pathUrls, _ := ns.MemoryStore.List()
+		got := make(map[string]string)
+		for _, pu := range pathUrls {
+			got[pu.key()] = pu.URL
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("apply(%s) left %v in memory, want %v", tt.payload, got, tt.want)
+		}
+	}
+	if err = ns.apply(`{"op": `); err == nil {
+		t.Errorf("apply of a malformed payload succeeded, want an error")
+	}
+}
+
+func TestNotifyTrigger(t *testing.T) {
+	db := testPostgres(t, pathsTable)
+	channel := fmt.Sprintf("urlshort_test_%d", time.Now().UnixNano())
+	if err := InstallNotifyTrigger(db, channel); err != nil {
+		t.Fatal(err)
+	}
+	dbConnParams, err := ParseDSN(os.Getenv("URLSHORT_TEST_DSN"), DSNOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := pq.NewListener(dbConnParams, time.Second, time.Second, nil)
+	defer listener.Close()
+	if err = listener.Listen(channel); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		statement string
+		want      []string
+	}{
+		{`insert into paths (path, url, clicks_left) values ('/a', 'https://example.com', 2)`, []string{"upsert /a"}},
+		{`update paths set clicks_left = clicks_left - 1 where path = '/a'`, []string{"clicks /a 1"}},
+		{`update paths set clicks_left = clicks_left where path = '/a'`, nil},
+		{`update paths set url = 'https://example.com/b' where path = '/a'`, []string{"upsert /a"}},
+		{`update paths set path = '/b' where path = '/a'`, []string{"delete /a", "upsert /b"}},
+		{`delete from paths`, []string{"delete /b"}},
+	}
+	for _, tt := range tests {
+		if _, err = db.Exec(tt.statement); err != nil {
+			t.Fatalf("%s: %v", tt.statement, err)
+		}
+		var got []string
+		for done := false; !done; {
+			select {
+			case n := <-listener.Notify:
+				var pn pathNotification
+				if err = json.Unmarshal([]byte(n.Extra), &pn); err != nil {
+					t.Fatalf("%s notified %q: %v", tt.statement, n.Extra, err)
+				}
+				got = append(got, pn.Op+" "+pn.Path)
+				if pn.ClicksLeft != nil {
+					got[len(got)-1] += fmt.Sprintf(" %d", *pn.ClicksLeft)
+				}
+			case <-time.After(200 * time.Millisecond):
+				done = true
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s notified %q, want %q", tt.statement, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package goUrlShortener
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// define how link passwords are hashed
+// * PasswordHash has the form `pbkdf2-sha256$<iterations>$<salt>$<hash>`, with the salt and hash in unpadded base64
+// * the iterations are stored with the hash, so they can be raised without invalidating existing hashes
+const (
+	passwordHashScheme     = "pbkdf2-sha256"
+	passwordHashIterations = 210000
+	passwordSaltLength     = 16
+	passwordKeyLength      = 32
+)
+
+// define how failed password attempts are limited
+// * at most passwordMaxFailures wrong passwords are accepted per client and link within passwordFailureWindow
+// * further attempts from that client are refused with 429 until the window has passed, whatever the password
+// * other clients can still try, so guessing from one address cannot lock the link for everyone
+const (
+	passwordMaxFailures   = 5
+	passwordFailureWindow = time.Minute
+)
+
+// DefaultPasswordCookieTTL is how long a visitor who entered a link's password is not asked for it again
+const DefaultPasswordCookieTTL = 24 * time.Hour
+
+// passwordCookiePrefix starts the name of every password cookie, which is followed by a hash of the link's key
+const passwordCookiePrefix = "gus_pw_"
+
+// passwordForm is the page that asks for the password of a protected link
+//  * the form posts back to the same url, so the query string of the request is kept
+var passwordForm = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Password required</title></head>
+<body>
+<form method="post">
+<p>The link {{.Path}} is protected by a password.</p>
+{{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+<input type="password" name="password" autofocus>
+<input type="submit" value="Continue">
+</form>
+</body>
+</html>
+`))
+
+// HashPassword returns a salted hash of password, ready to be stored as the PasswordHash of a PathURL
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", errors.Wrap(err, "failed to generate salt")
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordHashIterations, passwordKeyLength)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to hash password")
+	}
+	return strings.Join([]string{
+		passwordHashScheme,
+		strconv.Itoa(passwordHashIterations),
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	}, "$"), nil
+}
+
+// parsePasswordHash splits a PasswordHash into its iterations, salt and hash
+func parsePasswordHash(passwordHash string) (iterations int, salt, key []byte, err error) {
+	parts := strings.Split(passwordHash, "$")
+	if len(parts) != 4 || parts[0] != passwordHashScheme {
+		return 0, nil, nil, errors.Errorf("invalid password_hash, use the %s$<iterations>$<salt>$<hash> format", passwordHashScheme)
+	}
+	if iterations, err = strconv.Atoi(parts[1]); err != nil || iterations < 1 {
+		return 0, nil, nil, errors.Errorf("invalid password_hash iterations %q", parts[1])
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil {
+		return 0, nil, nil, errors.Wrap(err, "invalid password_hash salt")
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil || len(key) == 0 {
+		return 0, nil, nil, errors.New("invalid password_hash hash")
+	}
+	return iterations, salt, key, nil
+}
+
+// checkPassword reports whether password matches passwordHash, comparing in constant time
+func checkPassword(passwordHash, password string) bool {
+	iterations, salt, key, err := parsePasswordHash(passwordHash)
+	if err != nil {
+		return false
+	}
+	candidate, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(key))
+	return err == nil && subtle.ConstantTimeCompare(candidate, key) == 1
+}
+
+// checkPasswordHash rejects a PasswordHash that checkPassword could never match
+func checkPasswordHash(pu PathURL) error {
+	if pu.PasswordHash == "" {
+		return nil
+	}
+	_, _, _, err := parsePasswordHash(pu.PasswordHash)
+	return err
+}
+
+// passwordGate asks for the password of protected links, and remembers verified visitors with a signed cookie
+//  * the cookie is bound to the link and its PasswordHash, so changing the password asks every visitor again
+type passwordGate struct {
+	key []byte
+	ttl time.Duration
+
+	mu       sync.Mutex
+	failures map[string]*passwordFailures // failed attempts per failureKey
+}
+
+// passwordFailures counts the failed attempts of a client on a link since `since`
+type passwordFailures struct {
+	count int
+	since time.Time
+}
+
+// newPasswordGate returns a passwordGate signing its cookies with key, or with a random key when key is empty
+//  * a random key only lasts as long as the process, and is not shared with other instances
+func newPasswordGate(key []byte, ttl time.Duration) *passwordGate {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(errors.Wrap(err, "failed to generate the password cookie key")) // crypto/rand never fails on supported platforms
+		}
+	}
+	if ttl <= 0 {
+		ttl = DefaultPasswordCookieTTL
+	}
+	return &passwordGate{key: key, ttl: ttl, failures: make(map[string]*passwordFailures)}
+}
+
+// allow reports whether the visitor may be redirected through pu
+//  * true when the request carries a valid cookie for pu, or posts the right password, in which case the cookie is set
+//  * otherwise the password form, a failed attempt, or the rate limit response has already been written
+func (g *passwordGate) allow(w http.ResponseWriter, r *http.Request, pu PathURL) bool {
+	name := passwordCookiePrefix + g.sign(pu.key())[:16]
+	if c, err := r.Cookie(name); err == nil && g.validCookie(c.Value, pu, time.Now()) {
+		return true
+	}
+	if r.Method != http.MethodPost {
+		g.form(w, http.StatusUnauthorized, pu, "")
+		return false
+	}
+
+	failureKey := failureKey(r, pu)
+	if retryAfter := g.limited(failureKey, time.Now()); retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds()+1)))
+		g.form(w, http.StatusTooManyRequests, pu, "Too many wrong passwords, please try again later.")
+		return false
+	}
+	if !checkPassword(pu.PasswordHash, r.PostFormValue("password")) {
+		g.fail(failureKey, time.Now())
+		g.form(w, http.StatusUnauthorized, pu, "Wrong password.")
+		return false
+	}
+
+	expires := time.Now().Add(g.ttl)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    g.cookieValue(pu, expires),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return true
+}
+
+// form writes the password form with the given status and error message
+func (g *passwordGate) form(w http.ResponseWriter, status int, pu PathURL, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := passwordForm.Execute(w, struct{ Path, Error string }{pu.Path, message}); err != nil {
+		log.Printf("Failed to write the password form for path %s: %v", pu.key(), err)
+	}
+}
+
+// failureKey returns the key failed attempts are counted under i.e. the client IP, without its port, and the link key
+//  * behind a reverse proxy every client shares the proxy's address, and so its limit
+func failureKey(r *http.Request, pu PathURL) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host + "\x00" + pu.key()
+}
+
+// limited returns how long to wait before the next attempt under key, zero when an attempt is allowed
+func (g *passwordGate) limited(key string, now time.Time) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f, ok := g.failures[key]
+	if !ok {
+		return 0
+	}
+	if now.Sub(f.since) >= passwordFailureWindow {
+		delete(g.failures, key)
+		return 0
+	}
+	if f.count < passwordMaxFailures {
+		return 0
+	}
+	return f.since.Add(passwordFailureWindow).Sub(now)
+}
+
+// fail records a failed attempt under key
+//  * keys whose window has passed are dropped on the way, so the map only holds recent attempts
+func (g *passwordGate) fail(key string, now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for k, f := range g.failures {
+		if now.Sub(f.since) >= passwordFailureWindow {
+			delete(g.failures, k)
+		}
+	}
+	f, ok := g.failures[key]
+	if !ok {
+		f = &passwordFailures{since: now}
+		g.failures[key] = f
+	}
+	f.count++
+}
+
+// cookieValue returns the signed cookie value that lets a visitor through pu until expires i.e. `<expires>.<signature>`
+func (g *passwordGate) cookieValue(pu PathURL, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + g.sign(pu.key()+"\x00"+pu.PasswordHash+"\x00"+exp)
+}
+
+// validCookie reports whether value was signed for pu, with its current PasswordHash, and has not expired at now
+func (g *passwordGate) validCookie(value string, pu PathURL, now time.Time) bool {
+	i := strings.Index(value, ".")
+	if i < 0 {
+		return false
+	}
+	exp, err := strconv.ParseInt(value[:i], 10, 64)
+	if err != nil || now.Unix() >= exp {
+		return false
+	}
+	return hmac.Equal([]byte(value), []byte(g.cookieValue(pu, time.Unix(exp, 0))))
+}
+
+// sign returns the hex HMAC-SHA256 of message under the gate's key
+func (g *passwordGate) sign(message string) string {
+	mac := hmac.New(sha256.New, g.key)
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,74 @@
+package goUrlShortener
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPasswordGateLimit(t *testing.T) {
+	passwordHash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pu := PathURL{Path: "/docs", URL: "https://example.com/docs", PasswordHash: passwordHash}
+	other := PathURL{Path: "/other", URL: "https://example.com/other", PasswordHash: passwordHash}
+	gate := newPasswordGate(nil, 0)
+
+	type attempt struct {
+		client, password string
+		pu               PathURL
+		want             int
+	}
+	var attempts []attempt
+	for i := 0; i < passwordMaxFailures; i++ {
+		attempts = append(attempts, attempt{"192.0.2.1:1000", "wrong", pu, http.StatusUnauthorized})
+	}
+	attempts = append(attempts,
+		attempt{"192.0.2.1:1000", "secret", pu, http.StatusTooManyRequests}, // even with the right password
+		attempt{"192.0.2.1:2000", "secret", pu, http.StatusTooManyRequests}, // from another port of the same client
+		attempt{"192.0.2.1:1000", "secret", other, http.StatusOK},           // on another link
+		attempt{"192.0.2.2:1000", "wrong", pu, http.StatusUnauthorized},     // from another client
+		attempt{"192.0.2.2:1000", "secret", pu, http.StatusOK},
+	)
+	for i, a := range attempts {
+		r := httptest.NewRequest(http.MethodPost, a.pu.Path, strings.NewReader(url.Values{"password": {a.password}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = a.client
+		w := httptest.NewRecorder()
+		got := http.StatusOK
+		if !gate.allow(w, r, a.pu) {
+			got = w.Code
+		}
+		if got != a.want {
+			t.Errorf("attempt %d: %s with %q on %s = %d, want %d", i, a.client, a.password, a.pu.Path, got, a.want)
+		}
+	}
+}
+
+func TestLinksAPIHidesPasswordHash(t *testing.T) {
+	passwordHash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore([]PathURL{{Path: "/docs", URL: "https://example.com/docs", PasswordHash: passwordHash}})
+	api := NewLinksAPI(store, CodeGenerator{}, URLPolicy{})
+
+	for _, target := range []string{"/api/links/docs", "/api/links"} {
+		w := serveAPI(api, http.MethodGet, target, "", "")
+		if strings.Contains(w.Body.String(), passwordHash) || !strings.Contains(w.Body.String(), `"protected":true`) {
+			t.Errorf("GET %s = %s, shows the password hash or hides that the link is protected", target, w.Body)
+		}
+	}
+
+	w := serveAPI(api, http.MethodPatch, "/api/links/docs", "*", `{"url": "https://example.com/moved"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PATCH = %d: %s", w.Code, w.Body)
+	}
+	pu, _, err := store.Lookup("/docs")
+	if err != nil || pu.PasswordHash != passwordHash {
+		t.Errorf("a PATCH without a password lost the password hash: %q, %v", pu.PasswordHash, err)
+	}
+}
@@ -0,0 +1,150 @@
+package goUrlShortener
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// define the connection pool limits of the long-lived database handle opened by OpenPostgres
+// * lookups are single-row reads, so a small pool serves many concurrent redirects
+const (
+	dbMaxOpenConns    = 20
+	dbMaxIdleConns    = 10
+	dbConnMaxLifetime = 30 * time.Minute
+)
+
+// redactedSecret replaces a password in everything RedactDSN returns
+const redactedSecret = "REDACTED"
+
+// dsnPasswordPattern finds the password of a key/value DSN e.g. `password=secret` or `password='a secret'`
+var dsnPasswordPattern = regexp.MustCompile(`(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// urlPasswordPattern finds the password in the user info of a URL that does not parse e.g. `postgres://user:secret@[host`
+var urlPasswordPattern = regexp.MustCompile(`(://[^:/@]*:)[^@]*@`)
+
+// queryPasswordPattern finds a password in the query of a URL e.g. `?password=secret` or `&dbUserPassword=secret`, even when it is not escaped properly
+var queryPasswordPattern = regexp.MustCompile(`([?&;]|^)((?:password|dbUserPassword)=)[^&;#]*`)
+
+// DSNOptions declares the connection settings that win over those in a data source name
+//  * PasswordFile names a file holding the password, its trailing newline removed
+//  * SSLMode, SSLRootCert, SSLCert and SSLKey set the libpq setting of the same name
+//  * an empty field leaves the data source name as it is
+type DSNOptions struct {
+	PasswordFile string
+	SSLMode      string
+	SSLRootCert  string
+	SSLCert      string
+	SSLKey       string
+}
+
+// ParseDSN turns a Postgres data source name into the key/value connection parameters of sql.Open and pq.NewListener
+//  * the data source name may be a URL e.g. `postgres://<user>:<password>@<host>:<port>/<database>?sslmode=verify-full`
+//  * or libpq key/value pairs e.g. `host=<host> port=<port> user=<user> dbname=<database>`
+//  * or the older `<protocol>://<host>:<port>/<database>?dbUser=<user>&dbUserPassword=<password>`, which keeps `sslmode=disable`
+//  * opts are added last, so they win over the same settings in the data source name
+//  * without any password, lib/pq reads PGPASSWORD, then ~/.pgpass (or the PGPASSFILE file)
+//  * returns a *ParseError, which never holds the password, when the data source name does not parse
+func ParseDSN(dsn string, opts DSNOptions) (string, error) {
+	var dbConnParams string
+	u, err := url.Parse(dsn)
+	switch {
+	case !strings.Contains(dsn, "://"): // key/value pairs
+		dbConnParams = dsn
+	case err != nil:
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err // the url.Error quotes the whole URL, password included
+		}
+		return "", &ParseError{Source: RedactDSN(dsn), Err: err}
+	case u.Scheme == "postgres" || u.Scheme == "postgresql":
+		if dbConnParams, err = pq.ParseURL(dsn); err != nil {
+			return "", &ParseError{Source: RedactDSN(dsn), Err: err}
+		}
+	default: // the older format, named after its dbUser and dbUserPassword query keys
+		query := u.Query()
+		params := [][2]string{
+			{"host", u.Hostname()},
+			{"port", u.Port()},
+			{"dbname", strings.TrimLeft(u.Path, "/")},
+			{"user", query.Get("dbUser")},
+			{"password", query.Get("dbUserPassword")},
+			{"sslmode", "disable"},
+		}
+		var pairs []string
+		for _, param := range params {
+			if param[1] != "" {
+				pairs = append(pairs, param[0]+"="+dsnQuote(param[1]))
+			}
+		}
+		dbConnParams = strings.Join(pairs, " ")
+	}
+
+	overrides := [][2]string{
+		{"sslmode", opts.SSLMode},
+		{"sslrootcert", opts.SSLRootCert},
+		{"sslcert", opts.SSLCert},
+		{"sslkey", opts.SSLKey},
+	}
+	if opts.PasswordFile != "" {
+		password, err := ioutil.ReadFile(opts.PasswordFile)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to read the password file: %s", opts.PasswordFile)
+		}
+		overrides = append(overrides, [2]string{"password", strings.TrimRight(string(password), "\r\n")})
+	}
+	for _, override := range overrides {
+		if override[1] != "" { // a later key wins over an earlier one
+			dbConnParams += " " + override[0] + "=" + dsnQuote(override[1])
+		}
+	}
+	return dbConnParams, nil
+}
+
+// RedactDSN replaces the password in a data source name, in any form ParseDSN accepts, with REDACTED
+//  * key/value pairs are told apart from a URL the same way ParseDSN does, by the lack of `://`, since they need not parse as a URL
+func RedactDSN(dsn string) string {
+	if !strings.Contains(dsn, "://") {
+		return dsnPasswordPattern.ReplaceAllString(dsn, "${1}"+redactedSecret)
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		dsn = urlPasswordPattern.ReplaceAllString(dsn, "${1}"+redactedSecret+"@")
+		return queryPasswordPattern.ReplaceAllString(dsn, "${1}${2}"+redactedSecret)
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redactedSecret)
+	}
+	u.RawQuery = queryPasswordPattern.ReplaceAllString(u.RawQuery, "${1}${2}"+redactedSecret)
+	return u.String()
+}
+
+// dsnQuote quotes a value of a key/value connection string, escaping its backslashes and single quotes
+func dsnQuote(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// OpenPostgres opens a connection pool with the connection parameters returned by ParseDSN
+//  * sizes the pool for a handle that lives as long as the server runs
+//  * pings the database, so that an unreachable database is reported at once rather than on the first request
+//  * returns a *ConnectionError when the database cannot be reached, and the caller owns closing the pool otherwise
+func OpenPostgres(dbConnParams string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dbConnParams)
+	if err != nil {
+		return nil, &ConnectionError{Err: err}
+	}
+	db.SetMaxOpenConns(dbMaxOpenConns)
+	db.SetMaxIdleConns(dbMaxIdleConns)
+	db.SetConnMaxLifetime(dbConnMaxLifetime)
+
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, &ConnectionError{Err: err}
+	}
+	return db, nil
+}
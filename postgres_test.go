@@ -0,0 +1,127 @@
+package goUrlShortener
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactDSN(t *testing.T) {
+	tests := []struct {
+		dsn, want string
+	}{
+		{`host=x user=u dbname=d`, `host=x user=u dbname=d`},
+		{`password=a:b host=x`, `password=REDACTED host=x`},
+		{`password=sec%ret host=x`, `password=REDACTED host=x`},
+		{`host=x password='a secret' user=u`, `host=x password=REDACTED user=u`},
+		{`host=x password = 'it\'s' dbname=d`, `host=x password = REDACTED dbname=d`},
+		{`postgres://u:secret@h:5432/db?sslmode=disable`, `postgres://u:REDACTED@h:5432/db?sslmode=disable`},
+		{`postgres://u@h/db?password=secret&sslmode=require`, `postgres://u@h/db?password=REDACTED&sslmode=require`},
+		{`postgres://u@h/db?sslmode=require&password=sec%zzret`, `postgres://u@h/db?sslmode=require&password=REDACTED`},
+		{`postgres://u:secret@[h/db?password=secret`, `postgres://u:REDACTED@[h/db?password=REDACTED`},
+		{`tcp://h:5432/db?dbUser=u&dbUserPassword=secret`, `tcp://h:5432/db?dbUser=u&dbUserPassword=REDACTED`},
+	}
+	for _, tt := range tests {
+		if got := RedactDSN(tt.dsn); got != tt.want {
+			t.Errorf("RedactDSN(%q) = %q, want %q", tt.dsn, got, tt.want)
+		}
+	}
+}
+
+func TestParseDSN(t *testing.T) {
+	tests := []struct {
+		dsn  string
+		opts DSNOptions
+		want string
+	}{
+		{`host=h user=u dbname=d`, DSNOptions{}, `host=h user=u dbname=d`},
+		{`postgres://u:p@h:5432/db?sslmode=require`, DSNOptions{}, `dbname=db host=h password=p port=5432 sslmode=require user=u`},
+		{`tcp://h:5432/db?dbUser=u&dbUserPassword=it's`, DSNOptions{}, `host='h' port='5432' dbname='db' user='u' password='it\'s' sslmode='disable'`},
+		{`host=h sslmode=disable`, DSNOptions{SSLMode: "verify-full", SSLRootCert: "/ca.pem"}, `host=h sslmode=disable sslmode='verify-full' sslrootcert='/ca.pem'`},
+	}
+	for _, tt := range tests {
+		got, err := ParseDSN(tt.dsn, tt.opts)
+		if err != nil {
+			t.Errorf("ParseDSN(%q) failed: %v", tt.dsn, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseDSN(%q) = %q, want %q", tt.dsn, got, tt.want)
+		}
+	}
+}
+
+func TestParseDSNPasswordFile(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseDSN(`postgres://u:old@h/db`, DSNOptions{PasswordFile: passwordFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `dbname=db host=h password=old user=u password='s3cret'`; got != want {
+		t.Errorf("ParseDSN = %q, want %q", got, want)
+	}
+}
+
+func TestParseDSNMalformed(t *testing.T) {
+	_, err := ParseDSN(`postgres://u:secret@[h/db`, DSNOptions{})
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("ParseDSN returned %v, want a *ParseError", err)
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("the error leaks the password: %v", err)
+	}
+}
+
+// pathsTable creates the `paths` table with every column the README lists
+const pathsTable = `create table paths (
+	host text not null default '', path text not null, url text not null, status integer, query_policy text,
+	not_before timestamptz, expires_at timestamptz, clicks_left integer, password_hash text, primary key (host, path))`
+
+// testPostgres opens the database named by URLSHORT_TEST_DSN, in a schema of its own that is dropped when the test ends
+//  * skips the test when URLSHORT_TEST_DSN is not set
+//  * runs every statement of setup in that schema first
+func testPostgres(t *testing.T, setup ...string) *sql.DB {
+	dsn := os.Getenv("URLSHORT_TEST_DSN")
+	if dsn == "" {
+		t.Skip("URLSHORT_TEST_DSN is not set")
+	}
+	dbConnParams, err := ParseDSN(dsn, DSNOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("urlshort_test_%d", time.Now().UnixNano())
+	admin, err := OpenPostgres(dbConnParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = admin.Exec(`create schema ` + schema); err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+	db, err := OpenPostgres(dbConnParams + " search_path=" + schema)
+	if err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		admin.Exec(`drop schema ` + schema + ` cascade`)
+		admin.Close()
+	})
+	for _, statement := range setup {
+		if _, err = db.Exec(statement); err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+	return db
+}
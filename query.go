@@ -0,0 +1,63 @@
+package goUrlShortener
+
+import (
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// QueryPolicy decides what happens to the query string of an incoming request when it is redirected
+type QueryPolicy string
+
+// define the query policies
+// * QueryDrop redirects to the destination as it is, dropping the incoming query
+// * QueryAppend adds the incoming query after the destination's own query, keeping both values of a repeated key
+// * QueryMergeIncoming merges both queries, the incoming value replacing the destination's on a repeated key
+// * QueryMergeDestination merges both queries, the destination's value winning on a repeated key
+const (
+	QueryDrop             QueryPolicy = "drop"
+	QueryAppend           QueryPolicy = "append"
+	QueryMergeIncoming    QueryPolicy = "merge_incoming"
+	QueryMergeDestination QueryPolicy = "merge_destination"
+)
+
+// CheckQueryPolicy rejects unknown query policies, the empty policy is accepted as "use the default"
+func CheckQueryPolicy(policy QueryPolicy) error {
+	switch policy {
+	case "", QueryDrop, QueryAppend, QueryMergeIncoming, QueryMergeDestination:
+		return nil
+	}
+	return errors.Errorf("invalid query policy %q, use %s, %s, %s or %s", policy, QueryDrop, QueryAppend, QueryMergeIncoming, QueryMergeDestination)
+}
+
+// applyQueryPolicy combines the incoming raw query with the destination, following policy
+//  * the destination is returned unchanged when there is no incoming query, or the policy is QueryDrop
+func applyQueryPolicy(dest, incoming string, policy QueryPolicy) (string, error) {
+	if incoming == "" || policy == "" || policy == QueryDrop {
+		return dest, nil
+	}
+	u, err := url.Parse(dest)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to parse destination: %s", dest)
+	}
+
+	if policy == QueryAppend {
+		if u.RawQuery == "" {
+			u.RawQuery = incoming
+		} else {
+			u.RawQuery += "&" + incoming
+		}
+		return u.String(), nil
+	}
+
+	incomingValues, _ := url.ParseQuery(incoming) // a malformed pair is skipped, every well-formed pair is kept
+	destValues := u.Query()
+	for key, values := range incomingValues {
+		if _, taken := destValues[key]; taken && policy == QueryMergeDestination {
+			continue
+		}
+		destValues[key] = values
+	}
+	u.RawQuery = destValues.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,30 @@
+package goUrlShortener
+
+import "testing"
+
+func TestApplyQueryPolicy(t *testing.T) {
+	tests := []struct {
+		dest, incoming string
+		policy         QueryPolicy
+		want           string
+	}{
+		{"https://example.com/a?x=1", "y=2", "", "https://example.com/a?x=1"},
+		{"https://example.com/a?x=1", "y=2", QueryDrop, "https://example.com/a?x=1"},
+		{"https://example.com/a?x=1", "", QueryAppend, "https://example.com/a?x=1"},
+		{"https://example.com/a", "y=2", QueryAppend, "https://example.com/a?y=2"},
+		{"https://example.com/a?x=1", "x=2&y=3", QueryAppend, "https://example.com/a?x=1&x=2&y=3"},
+		{"https://example.com/a?x=1&z=9", "x=2&y=3", QueryMergeIncoming, "https://example.com/a?x=2&y=3&z=9"},
+		{"https://example.com/a?x=1&z=9", "x=2&y=3", QueryMergeDestination, "https://example.com/a?x=1&y=3&z=9"},
+		{"https://example.com/a#top", "y=2", QueryMergeIncoming, "https://example.com/a?y=2#top"},
+		{"https://example.com/a", "y=2&%zz&w=4", QueryMergeIncoming, "https://example.com/a?w=4&y=2"},
+	}
+	for _, tt := range tests {
+		got, err := applyQueryPolicy(tt.dest, tt.incoming, tt.policy)
+		if err != nil || got != tt.want {
+			t.Errorf("applyQueryPolicy(%q, %q, %q) = %q, %v, want %q", tt.dest, tt.incoming, tt.policy, got, err, tt.want)
+		}
+	}
+	if _, err := applyQueryPolicy("https://example.com/%zz", "y=2", QueryAppend); err == nil {
+		t.Errorf("applyQueryPolicy of a destination that does not parse succeeded, want an error")
+	}
+}
@@ -0,0 +1,192 @@
+package goUrlShortener
+
+import (
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// prefixRuleSuffix ends the Path of a prefix rule
+//  * a mapping's Path may declare a rule instead of a single path
+//  * a prefix rule ends in `/*` e.g. `/gh/*`, and matches every path below it
+//  * the remainder of the matched path replaces the `*` in the URL e.g. `https://github.com/*`
+//  * a pattern rule has one or more `{name}` segments e.g. `/docs/{page}`, each matching exactly one path segment
+//  * the matched segments replace the `{name}` placeholders in the URL e.g. `https://wiki.example.com/{page}`
+const prefixRuleSuffix = "/*"
+
+// placeholderPattern finds the `{name}` placeholders of a pattern rule or its URL
+var placeholderPattern = regexp.MustCompile(`\{([A-Za-z0-9_]+)\}`)
+
+// PatternLister is implemented by Stores that can list their pattern rules without listing every mapping
+type PatternLister interface {
+	Patterns() ([]PathURL, error)
+}
+
+// isPrefixRule reports whether path declares a prefix rule
+func isPrefixRule(path string) bool {
+	return strings.HasSuffix(path, prefixRuleSuffix)
+}
+
+// isPatternRule reports whether path declares a pattern rule
+func isPatternRule(path string) bool {
+	return strings.Contains(path, "{")
+}
+
+// checkRule rejects rules that cannot be matched, or whose URL uses a placeholder the path does not capture
+func checkRule(pu PathURL) error {
+	prefix := isPrefixRule(pu.Path)
+	if strings.Contains(strings.TrimSuffix(pu.Path, prefixRuleSuffix), "*") {
+		return errors.Errorf("`*` is only allowed as the last segment i.e. `/*`")
+	}
+	if prefix && isPatternRule(pu.Path) {
+		return errors.Errorf("a rule cannot be both a prefix rule and a pattern rule")
+	}
+
+	names := make(map[string]bool)
+	for _, segment := range strings.Split(pu.Path, "/") {
+		if !strings.Contains(segment, "{") && !strings.Contains(segment, "}") {
+			continue
+		}
+		m := placeholderPattern.FindStringSubmatch(segment)
+		if m == nil || m[0] != segment {
+			return errors.Errorf("invalid segment %q, a placeholder must be a whole segment like `{name}`", segment)
+		}
+		if names[m[1]] {
+			return errors.Errorf("placeholder {%s} is used twice", m[1])
+		}
+		names[m[1]] = true
+	}
+	for _, m := range placeholderPattern.FindAllStringSubmatch(pu.URL, -1) {
+		if !names[m[1]] {
+			return errors.Errorf("url uses placeholder {%s} that the path does not capture", m[1])
+		}
+	}
+	return nil
+}
+
+// Match finds the mapping for host and path in store
+//  * the exact path wins, then the longest prefix rule, first among the mappings scoped to host, then among the catch-all mappings
+//  * then the pattern rule with the most literal segments, then the lowest pattern in byte order, again scoped to host first
+//  * prefix rules are found with one Lookup per path segment, so they work with every Store
+//  * pattern rules are only found in Stores that implement PatternLister, and only listed once every Lookup has missed
+//  * so a path served by Lookup never fails on the pattern rules of a layer that cannot list them
+//  * returns the matched mapping, and the destination with any captured values substituted into its URL
+func Match(store Store, host, path string) (pu PathURL, dest string, ok bool, err error) {
+	hosts := []string{""}
+	if host != "" {
+		hosts = []string{host, ""}
+	}
+	for _, h := range hosts {
+		pu, dest, ok, err = matchLookup(store, h, path)
+		if err != nil || ok {
+			return pu, dest, ok, err
+		}
+	}
+
+	lister, isLister := store.(PatternLister)
+	if !isLister {
+		return PathURL{}, "", false, nil
+	}
+	patterns, err := lister.Patterns()
+	if err != nil {
+		return PathURL{}, "", false, err
+	}
+	for _, h := range hosts {
+		if pu, dest, ok = matchPatterns(patterns, h, path); ok {
+			return pu, dest, true, nil
+		}
+	}
+	return PathURL{}, "", false, nil
+}
+
+// matchLookup finds the exact path, or else the longest prefix rule, among the mappings scoped to host, or the catch-all mappings when host is empty
+func matchLookup(store Store, host, path string) (pu PathURL, dest string, ok bool, err error) {
+	pu, ok, err = store.Lookup(HostKey(host, path))
+	if err != nil || ok {
+		return pu, pu.URL, ok, err
+	}
+
+	// try `/a/b/*`, then `/a/*`, then `/*` for the path `/a/b/c`
+	for i := strings.LastIndex(path, "/"); i >= 0; i = strings.LastIndex(path[:i], "/") {
+		pu, ok, err = store.Lookup(HostKey(host, path[:i]+prefixRuleSuffix))
+		if err != nil {
+			return PathURL{}, "", false, err
+		}
+		if ok {
+			return pu, strings.Replace(pu.URL, "*", escapeSegments(path[i+1:]), -1), true, nil
+		}
+	}
+	return PathURL{}, "", false, nil
+}
+
+// matchPatterns finds the first of patterns that matches path, among those scoped to host, or the catch-all ones when host is empty
+func matchPatterns(patterns []PathURL, host, path string) (PathURL, string, bool) {
+	for _, pu := range patterns {
+		if !strings.EqualFold(pu.Host, host) {
+			continue
+		}
+		if values, ok := matchPattern(pu.Path, path); ok {
+			dest := placeholderPattern.ReplaceAllStringFunc(pu.URL, func(placeholder string) string {
+				return url.PathEscape(values[placeholder[1:len(placeholder)-1]])
+			})
+			return pu, dest, true
+		}
+	}
+	return PathURL{}, "", false
+}
+
+// matchPattern matches path against a pattern rule, segment by segment
+//  * returns the value captured by each `{name}` segment
+func matchPattern(pattern, path string) (map[string]string, bool) {
+	patternSegments, pathSegments := strings.Split(pattern, "/"), strings.Split(path, "/")
+	if len(patternSegments) != len(pathSegments) {
+		return nil, false
+	}
+	values := make(map[string]string)
+	for i, segment := range patternSegments {
+		if m := placeholderPattern.FindStringSubmatch(segment); m != nil {
+			if pathSegments[i] == "" {
+				return nil, false // a placeholder never matches an empty segment
+			}
+			values[m[1]] = pathSegments[i]
+			continue
+		}
+		if segment != pathSegments[i] {
+			return nil, false
+		}
+	}
+	return values, true
+}
+
+// escapeSegments escapes each segment of a captured remainder, keeping the `/` between them
+//  * so a remainder can never add a query or fragment to the destination
+func escapeSegments(remainder string) string {
+	segments := strings.Split(remainder, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// sortPatterns orders pattern rules by precedence i.e. most literal segments first, then by path
+func sortPatterns(patterns []PathURL) {
+	literals := func(path string) int {
+		n := 0
+		for _, segment := range strings.Split(path, "/") {
+			if !isPatternRule(segment) {
+				n++
+			}
+		}
+		return n
+	}
+	sort.SliceStable(patterns, func(i, j int) bool {
+		li, lj := literals(patterns[i].Path), literals(patterns[j].Path)
+		if li != lj {
+			return li > lj
+		}
+		return patterns[i].Path < patterns[j].Path
+	})
+}
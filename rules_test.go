@@ -0,0 +1,77 @@
+package goUrlShortener
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestMatchPrecedence(t *testing.T) {
+	store := NewMemoryStore([]PathURL{
+		{Path: "/docs/intro", URL: "https://exact.example.com"},
+		{Path: "/docs/*", URL: "https://prefix.example.com/*"},
+		{Path: "/docs/api/*", URL: "https://longer-prefix.example.com/*"},
+		{Path: "/docs/{page}", URL: "https://pattern.example.com/{page}"},
+		{Path: "/{section}/{page}", URL: "https://loose-pattern.example.com/{section}/{page}"},
+		{Path: "/wiki/{page}", URL: "https://catch-all-pattern.example.com/{page}"},
+		{Path: "/team", URL: "https://catch-all.example.com/team"},
+		{Host: "go.corp", Path: "/team", URL: "https://host.example.com/team"},
+		{Host: "go.corp", Path: "/wiki/{page}", URL: "https://host-pattern.example.com/{page}"},
+		{Host: "go.corp", Path: "/blog/{post}", URL: "https://host-pattern.example.com/blog/{post}"},
+		{Path: "/blog", URL: "https://catch-all.example.com/blog"},
+		{Path: "/blog/*", URL: "https://catch-all-prefix.example.com/*"},
+	})
+
+	tests := []struct {
+		host, path, want string
+	}{
+		{"", "/docs/intro", "https://exact.example.com"},
+		{"", "/docs/api/v1/users", "https://longer-prefix.example.com/v1/users"},
+		{"", "/docs/setup", "https://prefix.example.com/setup"},
+		{"", "/news/today", "https://loose-pattern.example.com/news/today"},
+		{"go.corp", "/team", "https://host.example.com/team"},
+		{"other.corp", "/team", "https://catch-all.example.com/team"},
+		{"go.corp", "/wiki/home", "https://host-pattern.example.com/home"},
+		{"other.corp", "/wiki/home", "https://catch-all-pattern.example.com/home"},
+		{"go.corp", "/blog/hello", "https://catch-all-prefix.example.com/hello"}, // exact and prefix lookups, even catch-all ones, win over pattern rules
+		{"", "/missing", ""},
+	}
+	for _, tt := range tests {
+		_, dest, ok, err := Match(store, tt.host, tt.path)
+		if err != nil {
+			t.Errorf("Match(%q, %q) failed: %v", tt.host, tt.path, err)
+			continue
+		}
+		if ok != (tt.want != "") || dest != tt.want {
+			t.Errorf("Match(%q, %q) = %q, %v, want %q", tt.host, tt.path, dest, ok, tt.want)
+		}
+	}
+}
+
+// brokenPatterns is a Store whose pattern rules cannot be listed e.g. a Postgres layer that is down
+type brokenPatterns struct {
+	*MemoryStore
+}
+
+func (brokenPatterns) Patterns() ([]PathURL, error) {
+	return nil, errors.New("the database is down")
+}
+
+func TestMatchListsPatternsLast(t *testing.T) {
+	store := NewLayeredStore(
+		Layer{Name: "yaml", Store: NewMemoryStore([]PathURL{
+			{Path: "/promo", URL: "https://example.com/promo"},
+			{Host: "go.corp", Path: "/gh/*", URL: "https://github.com/*"},
+		})},
+		Layer{Name: "sql", Store: brokenPatterns{NewMemoryStore(nil)}},
+	)
+
+	for _, path := range []string{"/promo", "/gh/golang/go"} {
+		if _, _, ok, err := Match(store, "go.corp", path); err != nil || !ok {
+			t.Errorf("Match(%q) = %v, %v, want a hit that never lists the pattern rules", path, ok, err)
+		}
+	}
+	if _, _, _, err := Match(store, "go.corp", "/missing"); err == nil {
+		t.Errorf("Match of a miss did not report the failed pattern rules")
+	}
+}
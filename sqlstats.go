@@ -0,0 +1,225 @@
+package goUrlShortener
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// rollupCursorName names the row of the `click_rollup_cursor` table that tracks the `clicks` table
+const rollupCursorName = "clicks"
+
+// ReadClicks reads the rows of the `clicks` table written by the transactions after the one numbered `after`, in transaction order
+//  * ids are handed out when a row is inserted, but rows become visible when their transaction commits, in any order
+//  * so the cursor is the `txid` of the writing transaction, and only transactions older than every one still running are read
+//  * a transaction still running, on any instance, therefore holds back every later one, and none is ever skipped
+//  * reads about limit rows, but always whole transactions, so the last one may take it over limit
+func (s *PostgresClickSink) ReadClicks(after int64, limit int) ([]ClickEvent, int64, error) {
+	rows, err := s.db.Query(`with settled as (
+			select max(txid) as last from (
+				select txid from clicks where txid > $1 and txid < txid_snapshot_xmin(txid_current_snapshot())
+				order by txid limit $2) batch)
+		select txid, host, path, clicked_at, referrer, user_agent, ip, destination
+		from clicks, settled where txid > $1 and txid <= settled.last order by txid, id`, after, limit)
+	if err != nil {
+		return nil, after, errors.Wrap(err, "failed to read clicks")
+	}
+	defer rows.Close()
+
+	var events []ClickEvent
+	next := after
+	for rows.Next() {
+		var ev ClickEvent
+		if err = rows.Scan(&next, &ev.Host, &ev.Path, &ev.Time, &ev.Referrer, &ev.UserAgent, &ev.IP, &ev.Destination); err != nil {
+			return nil, after, errors.Wrap(err, "failed to scan click")
+		}
+		events = append(events, ev)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, after, errors.Wrap(err, "failed to read clicks")
+	}
+	return events, next, nil
+}
+
+// PostgresRollups is a Rollups backed by the rollup tables of a Postgres database
+//  * `click_hourly` counts the clicks per link and hour
+//  * `click_visitors` lists the visitors per link and day
+//  * `click_referrers` and `click_agents` count the clicks per link, day and referrer host or user agent family
+//  * `click_rollup_cursor` holds the `txid` of the last transaction of the `clicks` table rolled up
+//  * several instances may roll up at the same time, the cursor makes sure every click is only counted once
+//  * like PostgresClickSink it has no Close, main hands both the pool it opened for `-sql`
+type PostgresRollups struct {
+	db *sql.DB
+}
+
+// NewPostgresRollups returns a PostgresRollups that reads and writes through db
+func NewPostgresRollups(db *sql.DB) *PostgresRollups {
+	return &PostgresRollups{db: db}
+}
+
+// Cursor reads the `txid` of the last transaction of the `clicks` table rolled up
+func (pr *PostgresRollups) Cursor() (int64, error) {
+	var cursor int64
+	err := pr.db.QueryRow(`select last_txid from click_rollup_cursor where name = $1`, rollupCursorName).Scan(&cursor)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return cursor, errors.Wrap(err, "failed to read the rollup cursor")
+}
+
+// ApplyRollup adds ru to the rollup tables, and moves the cursor from `from` to `to`, in one transaction
+//  * the cursor row is updated first, which locks it until the transaction ends, so a concurrent ApplyRollup waits
+//  * and then finds the cursor moved
+func (pr *PostgresRollups) ApplyRollup(ru *ClickRollup, from, to int64) error {
+	tx, err := pr.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin the rollup")
+	}
+	if err = pr.applyRollup(tx, ru, from, to); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return errors.Wrap(tx.Commit(), "failed to commit the rollup")
+}
+
+// applyRollup runs the statements of ApplyRollup in tx
+func (pr *PostgresRollups) applyRollup(tx *sql.Tx, ru *ClickRollup, from, to int64) error {
+	if _, err := tx.Exec(`insert into click_rollup_cursor (name, last_txid) values ($1, 0) on conflict (name) do nothing`, rollupCursorName); err != nil {
+		return errors.Wrap(err, "failed to create the rollup cursor")
+	}
+	result, err := tx.Exec(`update click_rollup_cursor set last_txid = $3 where name = $1 and last_txid = $2`, rollupCursorName, from, to)
+	if err != nil {
+		return errors.Wrap(err, "failed to move the rollup cursor")
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return ErrCursorMoved
+	}
+
+	var hourly, visitors, referrers, agents rollupRows
+	for id, lr := range ru.links {
+		for hour, clicks := range lr.hourly {
+			hourly.add(id, hour, "", clicks)
+		}
+		for day, dayVisitors := range lr.visitors {
+			for visitor := range dayVisitors {
+				visitors.add(id, day, visitor, 0)
+			}
+		}
+		referrers.addCounts(id, lr.referrers)
+		agents.addCounts(id, lr.agents)
+	}
+	if _, err = tx.Exec(`insert into click_hourly (host, path, hour, clicks)
+		select host, path, to_timestamp(at), clicks from unnest($1::text[], $2::text[], $3::bigint[], $4::bigint[]) as r (host, path, at, clicks)
+		on conflict (host, path, hour) do update set clicks = click_hourly.clicks + excluded.clicks`,
+		pq.Array(hourly.hosts), pq.Array(hourly.paths), pq.Array(hourly.at), pq.Array(hourly.clicks)); err != nil {
+		return errors.Wrap(err, "failed to roll up hourly clicks")
+	}
+	if _, err = tx.Exec(`insert into click_visitors (host, path, day, visitor)
+		select host, path, to_timestamp(at), visitor from unnest($1::text[], $2::text[], $3::bigint[], $4::text[]) as r (host, path, at, visitor)
+		on conflict (host, path, day, visitor) do nothing`,
+		pq.Array(visitors.hosts), pq.Array(visitors.paths), pq.Array(visitors.at), pq.Array(visitors.values)); err != nil {
+		return errors.Wrap(err, "failed to roll up visitors")
+	}
+	if err = pr.applyCounts(tx, "click_referrers", "referrer", referrers); err != nil {
+		return err
+	}
+	return pr.applyCounts(tx, "click_agents", "agent", agents)
+}
+
+// applyCounts adds the per day counts in rows to table, whose counted column is column
+func (pr *PostgresRollups) applyCounts(tx *sql.Tx, table, column string, rows rollupRows) error {
+	statement := strings.NewReplacer("{table}", table, "{column}", column).Replace(
+		`insert into {table} (host, path, day, {column}, clicks)
+		select host, path, to_timestamp(at), value, clicks from unnest($1::text[], $2::text[], $3::bigint[], $4::text[], $5::bigint[]) as r (host, path, at, value, clicks)
+		on conflict (host, path, day, {column}) do update set clicks = {table}.clicks + excluded.clicks`)
+	_, err := tx.Exec(statement, pq.Array(rows.hosts), pq.Array(rows.paths), pq.Array(rows.at), pq.Array(rows.values), pq.Array(rows.clicks))
+	return errors.Wrapf(err, "failed to roll up %s", table)
+}
+
+// rollupRows collects the rows of a rollup table column by column, so that a single INSERT over unnest adds them all
+//  * at is the start of the hour or day in unix seconds, value the visitor, referrer host or user agent family
+//  * every row of a batch has its own key, as the rollup maps do, so no INSERT updates the same row twice
+type rollupRows struct {
+	hosts, paths, values []string
+	at, clicks           []int64
+}
+
+// add appends a row for the link id
+func (rr *rollupRows) add(id linkID, at int64, value string, clicks int64) {
+	rr.hosts = append(rr.hosts, id.Host)
+	rr.paths = append(rr.paths, id.Path)
+	rr.at = append(rr.at, at)
+	rr.values = append(rr.values, value)
+	rr.clicks = append(rr.clicks, clicks)
+}
+
+// addCounts appends a row for every per day count of the link id
+func (rr *rollupRows) addCounts(id linkID, counts map[int64]map[string]int64) {
+	for day, values := range counts {
+		for value, clicks := range values {
+			rr.add(id, day, value, clicks)
+		}
+	}
+}
+
+// LinkStats reads the stats of the link for host and path over the range [from, to) from the rollup tables
+func (pr *PostgresRollups) LinkStats(host, path string, from, to time.Time, top int) (LinkStats, error) {
+	host = strings.ToLower(host)
+	rows, err := pr.db.Query(`select hour, clicks from click_hourly where host = $1 and path = $2 and hour >= $3 and hour < $4`, host, path, from, to)
+	if err != nil {
+		return LinkStats{}, errors.Wrap(err, "failed to read hourly clicks")
+	}
+	defer rows.Close()
+	hourly := make(map[int64]int64)
+	for rows.Next() {
+		var hour time.Time
+		var clicks int64
+		if err = rows.Scan(&hour, &clicks); err != nil {
+			return LinkStats{}, errors.Wrap(err, "failed to scan hourly clicks")
+		}
+		hourly[hour.Unix()] = clicks
+	}
+	if err = rows.Err(); err != nil {
+		return LinkStats{}, errors.Wrap(err, "failed to read hourly clicks")
+	}
+
+	day := truncateDay(from)
+	var uniqueVisitors int64
+	if err = pr.db.QueryRow(`select count(distinct visitor) from click_visitors where host = $1 and path = $2 and day >= $3 and day < $4`,
+		host, path, day, to).Scan(&uniqueVisitors); err != nil {
+		return LinkStats{}, errors.Wrap(err, "failed to count visitors")
+	}
+	referrers, err := pr.topCounts("click_referrers", "referrer", host, path, day, to, top)
+	if err != nil {
+		return LinkStats{}, err
+	}
+	agents, err := pr.topCounts("click_agents", "agent", host, path, day, to, top)
+	if err != nil {
+		return LinkStats{}, err
+	}
+	return buildLinkStats(host, path, from, to, hourly, uniqueVisitors, referrers, agents), nil
+}
+
+// topCounts reads the top values of column in table for a link, over the days from `from` up to `to`
+func (pr *PostgresRollups) topCounts(table, column, host, path string, from, to time.Time, top int) ([]StatsCount, error) {
+	statement := strings.NewReplacer("{table}", table, "{column}", column).Replace(
+		`select {column}, sum(clicks) from {table} where host = $1 and path = $2 and day >= $3 and day < $4
+		group by {column} order by 2 desc, 1 limit $5`)
+	rows, err := pr.db.Query(statement, host, path, from, to, top)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", table)
+	}
+	defer rows.Close()
+	counts := []StatsCount{}
+	for rows.Next() {
+		var c StatsCount
+		if err = rows.Scan(&c.Value, &c.Clicks); err != nil {
+			return nil, errors.Wrapf(err, "failed to scan %s", table)
+		}
+		counts = append(counts, c)
+	}
+	return counts, errors.Wrapf(rows.Err(), "failed to read %s", table)
+}
@@ -0,0 +1,100 @@
+package goUrlShortener
+
+import (
+	"testing"
+	"time"
+)
+
+// clicksTable is the `clicks` table of the README
+const clicksTable = `create table clicks (
+	id          bigserial primary key,
+	host        text not null default '',
+	path        text not null,
+	clicked_at  timestamptz not null,
+	referrer    text not null default '',
+	user_agent  text not null default '',
+	ip          text not null default '',
+	destination text not null,
+	txid        bigint not null default txid_current())`
+
+func TestPostgresClickSinkCursor(t *testing.T) {
+	db := testPostgres(t, clicksTable)
+	sink := NewPostgresClickSink(db)
+	old := time.Now().Add(-time.Hour) // a backed-up batch, long past any settle delay
+
+	slow, err := db.Begin() // takes the lower id, then commits last
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Rollback()
+	if _, err = slow.Exec(`insert into clicks (path, clicked_at, destination) values ('/slow', $1, 'https://example.com')`, old); err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.WriteClicks([]ClickEvent{{Path: "/fast", Time: old, Destination: "https://example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	events, next, err := sink.ReadClicks(0, 10)
+	if err != nil || len(events) != 0 || next != 0 {
+		t.Fatalf("ReadClicks while an older transaction runs = %v, %d, %v, want nothing read", events, next, err)
+	}
+	if err = slow.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	events, next, err = sink.ReadClicks(0, 1)
+	if err != nil || len(events) != 1 || events[0].Path != "/slow" {
+		t.Fatalf("ReadClicks(0, 1) = %v, %v, want the /slow click", events, err)
+	}
+	events, next, err = sink.ReadClicks(next, 10)
+	if err != nil || len(events) != 1 || events[0].Path != "/fast" {
+		t.Fatalf("ReadClicks after /slow = %v, %v, want the /fast click", events, err)
+	}
+	if events, _, err = sink.ReadClicks(next, 10); err != nil || len(events) != 0 {
+		t.Errorf("ReadClicks after /fast = %v, %v, want nothing left", events, err)
+	}
+}
+
+// rollupTables are the rollup tables of the README
+var rollupTables = []string{
+	`create table click_hourly (host text not null, path text not null, hour timestamptz not null, clicks bigint not null, primary key (host, path, hour))`,
+	`create table click_visitors (host text not null, path text not null, day timestamptz not null, visitor text not null, primary key (host, path, day, visitor))`,
+	`create table click_referrers (host text not null, path text not null, day timestamptz not null, referrer text not null, clicks bigint not null, primary key (host, path, day, referrer))`,
+	`create table click_agents (host text not null, path text not null, day timestamptz not null, agent text not null, clicks bigint not null, primary key (host, path, day, agent))`,
+	`create table click_rollup_cursor (name text primary key, last_txid bigint not null)`,
+}
+
+func TestPostgresRollupsApply(t *testing.T) {
+	rollups := NewPostgresRollups(testPostgres(t, rollupTables...))
+	day := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+	click := func(at time.Duration, ip, referrer string) ClickEvent {
+		return ClickEvent{Path: "/promo", Time: day.Add(at), IP: ip, Referrer: referrer, UserAgent: "curl/8.0"}
+	}
+	batches := [][]ClickEvent{
+		{click(time.Minute, "192.0.2.0", ""), click(2*time.Minute, "192.0.2.0", "https://news.example/a")},
+		{click(3*time.Minute, "198.51.100.0", "https://news.example/b"), click(2*time.Hour, "192.0.2.0", "")},
+	}
+	for i, events := range batches {
+		if err := rollups.ApplyRollup(NewClickRollup(events), int64(i), int64(i+1)); err != nil {
+			t.Fatalf("batch %d: %v", i, err)
+		}
+	}
+	if err := rollups.ApplyRollup(NewClickRollup(batches[0]), 0, 1); err != ErrCursorMoved {
+		t.Errorf("ApplyRollup from a stale cursor = %v, want ErrCursorMoved", err)
+	}
+
+	ls, err := rollups.LinkStats("", "/promo", day, day.Add(24*time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ls.Total != 4 || ls.UniqueVisitors != 2 || ls.Hourly[0].Clicks != 3 || ls.Hourly[2].Clicks != 1 {
+		t.Errorf("LinkStats = %d clicks, %d visitors, %d and %d in hours 0 and 2, want 4, 2, 3 and 1",
+			ls.Total, ls.UniqueVisitors, ls.Hourly[0].Clicks, ls.Hourly[2].Clicks)
+	}
+	want := []StatsCount{{"(direct)", 2}, {"news.example", 2}}
+	if len(ls.TopReferrers) != 2 || ls.TopReferrers[0] != want[0] || ls.TopReferrers[1] != want[1] {
+		t.Errorf("TopReferrers = %v, want %v", ls.TopReferrers, want)
+	}
+	if len(ls.TopAgents) != 1 || ls.TopAgents[0] != (StatsCount{"curl", 4}) {
+		t.Errorf("TopAgents = %v, want curl with 4 clicks", ls.TopAgents)
+	}
+}
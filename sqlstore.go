@@ -0,0 +1,286 @@
+package goUrlShortener
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// patternsCacheTTL is how long PostgresStore serves its pattern rules from memory before re-reading them
+const patternsCacheTTL = 10 * time.Second
+
+// pathColumns lists the `paths` columns read into a PathURL, in the order scanPathURL scans them
+const pathColumns = `host, path, url, status, query_policy, not_before, expires_at, clicks_left, password_hash`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanPathURL scans the pathColumns of a row into a PathURL, turning null columns into zero values
+func scanPathURL(row rowScanner) (PathURL, error) {
+	var pu PathURL
+	var status sql.NullInt64
+	var queryPolicy sql.NullString
+	var notBefore, expiresAt sql.NullTime
+	var clicksLeft sql.NullInt64
+	var passwordHash sql.NullString
+	if err := row.Scan(&pu.Host, &pu.Path, &pu.URL, &status, &queryPolicy, &notBefore, &expiresAt, &clicksLeft, &passwordHash); err != nil {
+		return PathURL{}, err
+	}
+	pu.Status = int(status.Int64)
+	pu.Query = QueryPolicy(queryPolicy.String)
+	pu.PasswordHash = passwordHash.String
+	if notBefore.Valid {
+		pu.NotBefore = &notBefore.Time
+	}
+	if expiresAt.Valid {
+		pu.ExpiresAt = &expiresAt.Time
+	}
+	if clicksLeft.Valid {
+		left := int(clicksLeft.Int64)
+		pu.ClicksLeft = &left
+	}
+	return pu, nil
+}
+
+// pathArgs returns the pathColumns values of pu, turning zero values into nulls
+func pathArgs(pu PathURL) []interface{} {
+	return []interface{}{
+		strings.ToLower(pu.Host),
+		pu.Path,
+		pu.URL,
+		sql.NullInt64{Int64: int64(pu.Status), Valid: pu.Status != 0},
+		sql.NullString{String: string(pu.Query), Valid: pu.Query != ""},
+		pu.NotBefore, // a nil *time.Time is sent as null
+		pu.ExpiresAt,
+		pu.ClicksLeft,
+		sql.NullString{String: pu.PasswordHash, Valid: pu.PasswordHash != ""},
+	}
+}
+
+// PostgresStore is a Store backed by the `paths` table of a Postgres database
+//  * the table is expected to have a non-null `host` column (empty for catch-all mappings) and a `path` column, unique together
+//  * a `url` column, a nullable integer `status` column, and a nullable text `query_policy` column, where null means the server-wide default
+//  * nullable timestamptz `not_before` and `expires_at` columns, where null leaves that end of the window open
+//  * a nullable integer `clicks_left` column, where null means no click limit
+//  * and a nullable text `password_hash` column, where null means the link is not password-protected
+//  * every Lookup reads a single row, so the table can be far larger than the process memory
+//  * pattern rules are cached for patternsCacheTTL, so a changed pattern rule can take that long to be served
+//  * Close releases only the lookup statement, since `db` may be shared e.g. with the click sink, and is closed by whoever opened it
+type PostgresStore struct {
+	db         *sql.DB
+	policy     URLPolicy
+	lookupStmt *sql.Stmt
+
+	patternsMu      sync.Mutex
+	patterns        []PathURL
+	patternsExpires time.Time
+}
+
+// NewPostgresStore returns a PostgresStore that reads and writes through db, checking every row it reads against policy
+//  * the lookup statement is prepared once and re-used by every request
+//  * database/sql re-prepares it transparently on whichever pooled connection serves the request
+//  * returns a *SchemaError when the `paths` table or one of its columns is missing, a *ConnectionError for any other failure
+func NewPostgresStore(db *sql.DB, policy URLPolicy) (*PostgresStore, error) {
+	lookupStmt, err := db.Prepare(`select ` + pathColumns + ` from paths where host = $1 and path = $2`)
+	if err != nil {
+		return nil, errors.Wrap(dbError(err, "paths"), "failed to prepare the path lookup statement")
+	}
+	return &PostgresStore{db: db, policy: policy, lookupStmt: lookupStmt}, nil
+}
+
+// Close releases the prepared statements, but leaves `db` open for its owner to close
+func (ps *PostgresStore) Close() error {
+	return ps.lookupStmt.Close()
+}
+
+// Lookup reads the mapping for key
+func (ps *PostgresStore) Lookup(key string) (PathURL, bool, error) {
+	return ps.lookupHostPath(splitHostKey(key))
+}
+
+// lookupHostPath reads the mapping for host and path
+func (ps *PostgresStore) lookupHostPath(host, path string) (PathURL, bool, error) {
+	pu, err := scanPathURL(ps.lookupStmt.QueryRow(strings.ToLower(host), path))
+	if err == sql.ErrNoRows {
+		return PathURL{}, false, nil
+	}
+	if err != nil {
+		return PathURL{}, false, errors.Wrapf(dbError(err, "paths"), "failed to look up path: %s", HostKey(host, path))
+	}
+	valid, err := FilterPathUrls([]PathURL{pu}, ps.policy, func(int) string { return "the paths table" })
+	if err != nil || len(valid) == 0 { // a row skipped for its url is served as a miss
+		return PathURL{}, false, err
+	}
+	return pu, true, nil
+}
+
+// Put inserts the mapping for the host and path of pu, or updates it when they already exist
+func (ps *PostgresStore) Put(pu PathURL) error {
+	_, err := ps.db.Exec(`insert into paths (`+pathColumns+`) values ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		on conflict (host, path) do update set url = excluded.url, status = excluded.status, query_policy = excluded.query_policy,
+			not_before = excluded.not_before, expires_at = excluded.expires_at, clicks_left = excluded.clicks_left,
+			password_hash = excluded.password_hash`, pathArgs(pu)...)
+	if err == nil && isPatternRule(pu.Path) {
+		ps.expirePatterns()
+	}
+	return errors.Wrapf(err, "failed to store path: %s", pu.key())
+}
+
+// Delete removes the mapping for key
+func (ps *PostgresStore) Delete(key string) error {
+	host, path := splitHostKey(key)
+	result, err := ps.db.Exec(`delete from paths where host = $1 and path = $2`, host, path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete path: %s", key)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete path: %s", key)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	if isPatternRule(path) {
+		ps.expirePatterns()
+	}
+	return nil
+}
+
+// expirePatterns makes the next Patterns call re-read the pattern rules, after this store changed one
+func (ps *PostgresStore) expirePatterns() {
+	ps.patternsMu.Lock()
+	ps.patternsExpires = time.Time{}
+	ps.patternsMu.Unlock()
+}
+
+// Patterns reads the pattern rules in the `paths` table, in precedence order
+func (ps *PostgresStore) Patterns() ([]PathURL, error) {
+	ps.patternsMu.Lock()
+	defer ps.patternsMu.Unlock()
+	if time.Now().Before(ps.patternsExpires) {
+		return ps.patterns, nil
+	}
+
+	patterns, err := ps.query(`select ` + pathColumns + ` from paths where strpos(path, '{') > 0`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list pattern rules")
+	}
+	sortPatterns(patterns)
+	ps.patterns, ps.patternsExpires = patterns, time.Now().Add(patternsCacheTTL)
+	return patterns, nil
+}
+
+// List reads every mapping in the `paths` table, ordered by host and path
+//  * the whole list is rejected when any row is invalid, the same way a mapping file is, or the row is skipped when the URLPolicy says so
+func (ps *PostgresStore) List() ([]PathURL, error) {
+	pathUrls, err := ps.query(`select ` + pathColumns + ` from paths order by host, path`)
+	return pathUrls, errors.Wrap(err, "failed to list paths")
+}
+
+// ListPage reads a page of the mappings that filter keeps, sorted by host then path, along with how many the filter keeps when count is set
+//  * the filter, the order and the page all run in the database, so only the page is read into memory
+//  * rows are ordered byte by byte, as in every other Store, which walks a `(host collate "C", path collate "C")` index rather than sorting the table
+//  * the total needs every row the filter keeps, so it is left at -1 unless count is set
+//  * a row that fails its checks is handled as by List, though it still counts towards the total
+func (ps *PostgresStore) ListPage(filter ListFilter, offset, limit int, count bool) ([]PathURL, int, error) {
+	var where []string
+	var args []interface{}
+	add := func(clause string, arg interface{}) { // every ? of clause stands for arg
+		args = append(args, arg)
+		where = append(where, strings.Replace(clause, "?", "$"+strconv.Itoa(len(args)), -1))
+	}
+	if filter.ByHost {
+		add(`host = ?`, strings.ToLower(filter.Host))
+	}
+	if filter.Prefix != "" {
+		add(`path collate "C" like ?`, likePrefix(filter.Prefix))
+	}
+	if filter.Contains != "" {
+		add(`(strpos(path, ?) > 0 or strpos(url, ?) > 0)`, filter.Contains)
+	}
+	if len(filter.Exclude) > 0 {
+		add(`(host || path) <> all(?::text[])`, pq.Array(filter.Exclude))
+	}
+	var clause string
+	if len(where) > 0 {
+		clause = ` where ` + strings.Join(where, ` and `)
+	}
+
+	total := -1
+	if count {
+		if err := ps.db.QueryRow(`select count(*) from paths`+clause, args...).Scan(&total); err != nil {
+			return nil, 0, errors.Wrap(dbError(err, "paths"), "failed to count paths")
+		}
+	}
+	page := fmt.Sprintf(` order by host collate "C", path collate "C" offset $%d limit $%d`, len(args)+1, len(args)+2)
+	pathUrls, err := ps.query(`select `+pathColumns+` from paths`+clause+page, append(args, offset, limit)...)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to list paths")
+	}
+	if pathUrls == nil {
+		pathUrls = []PathURL{}
+	}
+	return pathUrls, total, nil
+}
+
+// likePrefix returns the LIKE pattern of the strings starting with prefix, escaping the wildcards in prefix
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+}
+
+// expired reads the mappings whose `expires_at` is not after `before`, so that sweeping never reads the whole table
+func (ps *PostgresStore) expired(before time.Time) ([]PathURL, error) {
+	pathUrls, err := ps.query(`select `+pathColumns+` from paths where expires_at <= $1 order by host, path`, before)
+	return pathUrls, errors.Wrap(err, "failed to list expired paths")
+}
+
+// Locate reads the whole `paths` table as written, naming the table as the location of every row
+//  * unlike List, rows that fail their checks are returned too
+func (ps *PostgresStore) Locate() ([]SourceMapping, error) {
+	pathUrls, err := ps.scan(`select ` + pathColumns + ` from paths order by host, path`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list paths")
+	}
+	mappings := make([]SourceMapping, len(pathUrls))
+	for i, pu := range pathUrls {
+		mappings[i] = SourceMapping{PathURL: pu, Location: "the paths table"}
+	}
+	return mappings, nil
+}
+
+// query runs a `select <pathColumns>` statement and checks every row, the same way a mapping file is
+func (ps *PostgresStore) query(sqlStatement string, args ...interface{}) ([]PathURL, error) {
+	pathUrls, err := ps.scan(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	return FilterPathUrls(pathUrls, ps.policy, func(int) string { return "the paths table" })
+}
+
+// scan runs a `select <pathColumns>` statement and scans every row into a PathURL
+//  * a failed query is classified by dbError, and a row that does not scan is a *SchemaError
+func (ps *PostgresStore) scan(sqlStatement string, args ...interface{}) ([]PathURL, error) {
+	rows, err := ps.db.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, dbError(err, "paths")
+	}
+	defer rows.Close()
+
+	var pathUrls []PathURL
+	for rows.Next() {
+		pu, err := scanPathURL(rows)
+		if err != nil {
+			return nil, &SchemaError{Table: "paths", Err: err}
+		}
+		pathUrls = append(pathUrls, pu)
+	}
+	return pathUrls, dbError(rows.Err(), "paths")
+}
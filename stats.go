@@ -0,0 +1,548 @@
+package goUrlShortener
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// define the limits of `GET /api/links/{path}?view=stats`
+// * without `from` and `to`, the last defaultStatsRange is returned
+// * a range may not span more than maxStatsRange, which keeps the hourly buckets to a few thousand
+// * at most maxStatsTop referrers and user agent families are returned, defaultStatsTop when `top` is missing
+const (
+	defaultStatsRange = 7 * 24 * time.Hour
+	maxStatsRange     = 92 * 24 * time.Hour
+	defaultStatsTop   = 10
+	maxStatsTop       = 100
+)
+
+// visitorRetention is how long MemoryRollups keeps the visitors of a day, for the unique visitors
+//  * the stats of older days still have their clicks, referrers and user agents, but no unique visitors
+const visitorRetention = maxStatsRange
+
+// DefaultAggregateBatch is how many click events the Aggregator rolls up at once
+const DefaultAggregateBatch = 5000
+
+// directReferrer counts the clicks that came without a referrer
+const directReferrer = "(direct)"
+
+// ErrCursorMoved is returned by Rollups.ApplyRollup when another aggregator already rolled up the same events
+var ErrCursorMoved = errors.New("the rollup cursor was moved by another aggregator")
+
+// LinkStats declares the body returned by `GET /api/links/{path}?view=stats`
+//  * Hourly and Daily hold a bucket for every hour and day of the range, including those without clicks
+//  * UniqueVisitors counts the distinct anonymized IP and user agent pairs, per day, over the days the range touches
+//  * TopReferrers and TopAgents count by referrer host and user agent family, over the days the range touches
+type LinkStats struct {
+	Host           string        `json:"host,omitempty"`
+	Path           string        `json:"path"`
+	From           time.Time     `json:"from"`
+	To             time.Time     `json:"to"`
+	Total          int64         `json:"total"`
+	UniqueVisitors int64         `json:"unique_visitors"`
+	Hourly         []StatsBucket `json:"hourly"`
+	Daily          []StatsBucket `json:"daily"`
+	TopReferrers   []StatsCount  `json:"top_referrers"`
+	TopAgents      []StatsCount  `json:"top_agents"`
+}
+
+// StatsBucket counts the clicks of the hour or day starting at Start
+type StatsBucket struct {
+	Start  time.Time `json:"start"`
+	Clicks int64     `json:"clicks"`
+}
+
+// StatsCount counts the clicks of a single referrer or user agent family
+type StatsCount struct {
+	Value  string `json:"value"`
+	Clicks int64  `json:"clicks"`
+}
+
+// ClickSource is implemented by click sinks whose events can be read back in the order they were written
+//  * ReadClicks returns at most limit events written after the cursor `after`, and the cursor of the last one
+//  * a cursor is only meaningful to the source that returned it, and 0 is the start of the source
+type ClickSource interface {
+	ReadClicks(after int64, limit int) (events []ClickEvent, next int64, err error)
+}
+
+// Rollups holds the rolled up clicks the stats API reads from, instead of scanning every click event
+//  * Cursor returns the cursor of the last event rolled up, 0 when none was
+//  * ApplyRollup adds ru, then moves the cursor from `from` to `to` in the same step
+//  * ApplyRollup returns ErrCursorMoved, and adds nothing, when the cursor is no longer at `from`
+//  * LinkStats reads the stats of the link for host and path over the range [from, to)
+type Rollups interface {
+	Cursor() (int64, error)
+	ApplyRollup(ru *ClickRollup, from, to int64) error
+	LinkStats(host, path string, from, to time.Time, top int) (LinkStats, error)
+}
+
+// linkID names the link a ClickEvent was counted towards
+type linkID struct {
+	Host, Path string
+}
+
+// linkRollup holds the rolled up clicks of a single link
+//  * hourly is keyed by the start of the hour, every other map by the start of the day, all in unix seconds
+type linkRollup struct {
+	hourly    map[int64]int64
+	visitors  map[int64]map[string]bool
+	referrers map[int64]map[string]int64
+	agents    map[int64]map[string]int64
+}
+
+// newLinkRollup returns an empty linkRollup
+func newLinkRollup() *linkRollup {
+	return &linkRollup{
+		hourly:    make(map[int64]int64),
+		visitors:  make(map[int64]map[string]bool),
+		referrers: make(map[int64]map[string]int64),
+		agents:    make(map[int64]map[string]int64),
+	}
+}
+
+// add counts ev
+func (lr *linkRollup) add(ev ClickEvent) {
+	t := ev.Time.UTC()
+	hour, day := t.Truncate(time.Hour).Unix(), truncateDay(t).Unix()
+	lr.hourly[hour]++
+	lr.addVisitor(day, visitorID(ev))
+	lr.addCount(lr.referrers, day, referrerHost(ev.Referrer), 1)
+	lr.addCount(lr.agents, day, agentFamily(ev.UserAgent), 1)
+}
+
+// addVisitor records that visitor clicked the link on day
+func (lr *linkRollup) addVisitor(day int64, visitor string) {
+	if lr.visitors[day] == nil {
+		lr.visitors[day] = make(map[string]bool)
+	}
+	lr.visitors[day][visitor] = true
+}
+
+// addCount adds clicks to the count of value on day
+func (lr *linkRollup) addCount(counts map[int64]map[string]int64, day int64, value string, clicks int64) {
+	if counts[day] == nil {
+		counts[day] = make(map[string]int64)
+	}
+	counts[day][value] += clicks
+}
+
+// merge adds every count of other to lr
+func (lr *linkRollup) merge(other *linkRollup) {
+	for hour, clicks := range other.hourly {
+		lr.hourly[hour] += clicks
+	}
+	for day, visitors := range other.visitors {
+		for visitor := range visitors {
+			lr.addVisitor(day, visitor)
+		}
+	}
+	for day, counts := range other.referrers {
+		for value, clicks := range counts {
+			lr.addCount(lr.referrers, day, value, clicks)
+		}
+	}
+	for day, counts := range other.agents {
+		for value, clicks := range counts {
+			lr.addCount(lr.agents, day, value, clicks)
+		}
+	}
+}
+
+// ClickRollup holds the rolled up counts of a batch of click events, ready to be added to Rollups
+type ClickRollup struct {
+	links map[linkID]*linkRollup
+}
+
+// NewClickRollup rolls up events
+func NewClickRollup(events []ClickEvent) *ClickRollup {
+	ru := &ClickRollup{links: make(map[linkID]*linkRollup)}
+	for _, ev := range events {
+		id := linkID{Host: strings.ToLower(ev.Host), Path: ev.Path}
+		if ru.links[id] == nil {
+			ru.links[id] = newLinkRollup()
+		}
+		ru.links[id].add(ev)
+	}
+	return ru
+}
+
+// truncateDay returns the start of the UTC day of t
+func truncateDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// visitorID identifies a visitor by a hash of its anonymized IP and user agent, so neither is stored in the rollups
+func visitorID(ev ClickEvent) string {
+	sum := sha256.Sum256([]byte(ev.IP + "\x00" + ev.UserAgent))
+	return hex.EncodeToString(sum[:8])
+}
+
+// referrerHost returns the host of a referrer, directReferrer when there is none
+func referrerHost(referrer string) string {
+	if referrer == "" {
+		return directReferrer
+	}
+	u, err := url.Parse(referrer)
+	if err != nil || u.Host == "" {
+		return referrer
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// agentFamilies maps a token found in a user agent to its family, the first matching token wins
+//  * the order matters, since e.g. every Chrome user agent also claims to be Safari
+var agentFamilies = []struct{ token, family string }{
+	{"bot", "Bot"},
+	{"crawler", "Bot"},
+	{"spider", "Bot"},
+	{"edg/", "Edge"},
+	{"opr/", "Opera"},
+	{"chrome/", "Chrome"},
+	{"crios/", "Chrome"},
+	{"firefox/", "Firefox"},
+	{"fxios/", "Firefox"},
+	{"safari/", "Safari"},
+	{"curl/", "curl"},
+	{"wget/", "Wget"},
+}
+
+// agentFamily returns the browser family of a user agent, `Other` when it is not recognized
+func agentFamily(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown"
+	}
+	ua := strings.ToLower(userAgent)
+	for _, af := range agentFamilies {
+		if strings.Contains(ua, af.token) {
+			return af.family
+		}
+	}
+	return "Other"
+}
+
+// Aggregator rolls up the click events of a ClickSource into Rollups, a batch at a time
+type Aggregator struct {
+	source  ClickSource
+	rollups Rollups
+	batch   int
+}
+
+// NewAggregator returns an Aggregator from source to rollups, reading batch events at a time, DefaultAggregateBatch when zero
+func NewAggregator(source ClickSource, rollups Rollups, batch int) *Aggregator {
+	if batch <= 0 {
+		batch = DefaultAggregateBatch
+	}
+	return &Aggregator{source: source, rollups: rollups, batch: batch}
+}
+
+// AggregateOnce rolls up every event written since the last roll up, and returns how many it rolled up
+//  * stops early, without error, when another aggregator is rolling up the same events
+func (ag *Aggregator) AggregateOnce() (int, error) {
+	total := 0
+	for {
+		from, err := ag.rollups.Cursor()
+		if err != nil {
+			return total, err
+		}
+		events, to, err := ag.source.ReadClicks(from, ag.batch)
+		if err != nil {
+			return total, err
+		}
+		if len(events) == 0 {
+			return total, nil
+		}
+		err = ag.rollups.ApplyRollup(NewClickRollup(events), from, to)
+		if err == ErrCursorMoved {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+		total += len(events)
+	}
+}
+
+// Run calls AggregateOnce every interval until stop is closed, logging failures
+//  * the first roll up runs on the call, so the stats catch up with the clicks recorded while the server was down
+func (ag *Aggregator) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := ag.AggregateOnce(); err != nil {
+			log.Printf("Failed to roll up click events: %v", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// MemoryRollups is an in-memory Rollups that is safe for concurrent use
+//  * without a checkpoint file, it starts with the cursor at 0, so it rolls up the whole ClickSource again after every restart
+//  * with one, it saves the rollups and the cursor to it after every ApplyRollup, and resumes from it on start
+//  * the visitors of a day are dropped once the day is more than visitorRetention ago, so they do not grow without bound
+type MemoryRollups struct {
+	mu         sync.RWMutex
+	cursor     int64
+	links      map[linkID]*linkRollup
+	checkpoint string
+}
+
+// memoryRollupsFile declares the content of the checkpoint file of MemoryRollups
+type memoryRollupsFile struct {
+	Cursor int64             `json:"cursor"`
+	Links  []linkRollupEntry `json:"links"`
+}
+
+// linkRollupEntry declares the rollup of a single link in the checkpoint file, with the maps of linkRollup
+type linkRollupEntry struct {
+	Host      string                     `json:"host"`
+	Path      string                     `json:"path"`
+	Hourly    map[int64]int64            `json:"hourly"`
+	Visitors  map[int64]map[string]bool  `json:"visitors"`
+	Referrers map[int64]map[string]int64 `json:"referrers"`
+	Agents    map[int64]map[string]int64 `json:"agents"`
+}
+
+// NewMemoryRollups returns an empty MemoryRollups, without a checkpoint file
+func NewMemoryRollups() *MemoryRollups {
+	return &MemoryRollups{links: make(map[linkID]*linkRollup)}
+}
+
+// LoadMemoryRollups returns a MemoryRollups that resumes from the checkpoint file, and saves to it
+//  * a missing file starts empty, with the cursor at 0, and is created by the first ApplyRollup
+//  * returns a *ParseError when the file does not parse
+func LoadMemoryRollups(checkpoint string) (*MemoryRollups, error) {
+	m := NewMemoryRollups()
+	m.checkpoint = checkpoint
+	data, err := ioutil.ReadFile(checkpoint)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read file: %s", checkpoint)
+	}
+	var file memoryRollupsFile
+	if err = json.Unmarshal(data, &file); err != nil {
+		return nil, &ParseError{Source: checkpoint, Err: err}
+	}
+	m.cursor = file.Cursor
+	for _, e := range file.Links {
+		lr := newLinkRollup()
+		lr.merge(&linkRollup{hourly: e.Hourly, visitors: e.Visitors, referrers: e.Referrers, agents: e.Agents})
+		m.links[linkID{Host: e.Host, Path: e.Path}] = lr
+	}
+	return m, nil
+}
+
+// Cursor returns the cursor of the last event rolled up
+func (m *MemoryRollups) Cursor() (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cursor, nil
+}
+
+// ApplyRollup adds ru, then moves the cursor from `from` to `to`
+//  * then drops the visitors of the days past visitorRetention, and saves the checkpoint file, if any
+//  * a failed save is returned, but the rollup is kept in memory, and the next ApplyRollup saves it again
+func (m *MemoryRollups) ApplyRollup(ru *ClickRollup, from, to int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cursor != from {
+		return ErrCursorMoved
+	}
+	for id, lr := range ru.links {
+		if m.links[id] == nil {
+			m.links[id] = newLinkRollup()
+		}
+		m.links[id].merge(lr)
+	}
+	m.cursor = to
+	m.expireVisitors(truncateDay(time.Now().Add(-visitorRetention)).Unix())
+	return m.save()
+}
+
+// expireVisitors drops the visitors of every day before `before`, in unix seconds
+func (m *MemoryRollups) expireVisitors(before int64) {
+	for _, lr := range m.links {
+		for day := range lr.visitors {
+			if day < before {
+				delete(lr.visitors, day)
+			}
+		}
+	}
+}
+
+// save writes the rollups and the cursor to the checkpoint file, at once, so a restart never counts an event twice
+func (m *MemoryRollups) save() error {
+	if m.checkpoint == "" {
+		return nil
+	}
+	file := memoryRollupsFile{Cursor: m.cursor, Links: make([]linkRollupEntry, 0, len(m.links))}
+	for id, lr := range m.links {
+		file.Links = append(file.Links, linkRollupEntry{
+			Host: id.Host, Path: id.Path, Hourly: lr.hourly, Visitors: lr.visitors, Referrers: lr.referrers, Agents: lr.agents,
+		})
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode rollups for file: %s", m.checkpoint)
+	}
+	return writeFileAtomic(m.checkpoint, data)
+}
+
+// LinkStats reads the stats of the link for host and path over the range [from, to)
+func (m *MemoryRollups) LinkStats(host, path string, from, to time.Time, top int) (LinkStats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	lr := m.links[linkID{Host: strings.ToLower(host), Path: path}]
+	if lr == nil {
+		lr = newLinkRollup()
+	}
+
+	hourly := make(map[int64]int64)
+	for hour := from.Unix(); hour < to.Unix(); hour += int64(time.Hour / time.Second) {
+		hourly[hour] = lr.hourly[hour]
+	}
+	visitors := make(map[string]bool)
+	referrers, agents := make(map[string]int64), make(map[string]int64)
+	for day := truncateDay(from).Unix(); day < to.Unix(); day += int64(24 * time.Hour / time.Second) {
+		for visitor := range lr.visitors[day] {
+			visitors[visitor] = true
+		}
+		for value, clicks := range lr.referrers[day] {
+			referrers[value] += clicks
+		}
+		for value, clicks := range lr.agents[day] {
+			agents[value] += clicks
+		}
+	}
+	return buildLinkStats(host, path, from, to, hourly, int64(len(visitors)), topCounts(referrers, top), topCounts(agents, top)), nil
+}
+
+// buildLinkStats assembles LinkStats from the clicks per hour, keyed by the unix start of the hour
+//  * every hour and day of the range gets a bucket, and the daily buckets are summed from the hourly ones
+func buildLinkStats(host, path string, from, to time.Time, hourly map[int64]int64, uniqueVisitors int64, referrers, agents []StatsCount) LinkStats {
+	ls := LinkStats{
+		Host:           host,
+		Path:           path,
+		From:           from,
+		To:             to,
+		UniqueVisitors: uniqueVisitors,
+		Hourly:         []StatsBucket{},
+		Daily:          []StatsBucket{},
+		TopReferrers:   referrers,
+		TopAgents:      agents,
+	}
+	for hour := from; hour.Before(to); hour = hour.Add(time.Hour) {
+		clicks := hourly[hour.Unix()]
+		ls.Total += clicks
+		ls.Hourly = append(ls.Hourly, StatsBucket{Start: hour, Clicks: clicks})
+		day := truncateDay(hour)
+		if n := len(ls.Daily); n == 0 || !ls.Daily[n-1].Start.Equal(day) {
+			ls.Daily = append(ls.Daily, StatsBucket{Start: day})
+		}
+		ls.Daily[len(ls.Daily)-1].Clicks += clicks
+	}
+	return ls
+}
+
+// topCounts returns the top counts, most clicks first then by value
+func topCounts(counts map[string]int64, top int) []StatsCount {
+	sorted := make([]StatsCount, 0, len(counts))
+	for value, clicks := range counts {
+		sorted = append(sorted, StatsCount{Value: value, Clicks: clicks})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Clicks != sorted[j].Clicks {
+			return sorted[i].Clicks > sorted[j].Clicks
+		}
+		return sorted[i].Value < sorted[j].Value
+	})
+	if len(sorted) > top {
+		sorted = sorted[:top]
+	}
+	return sorted
+}
+
+// statsRange reads the `from` and `to` query parameters, as RFC 3339 timestamps or `2006-01-02` dates
+//  * `to` defaults to now and `from` to defaultStatsRange before `to`
+//  * both are rounded out to whole hours, and the range may not exceed maxStatsRange
+func statsRange(query url.Values, now time.Time) (from, to time.Time, err error) {
+	parse := func(name string, def time.Time) (time.Time, error) {
+		value := query.Get(name)
+		if value == "" {
+			return def, nil
+		}
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return t, nil
+		}
+		if t, err := time.Parse("2006-01-02", value); err == nil {
+			return t, nil
+		}
+		return time.Time{}, errors.Errorf("%s must be an RFC 3339 timestamp or a 2006-01-02 date", name)
+	}
+	if to, err = parse("to", now); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if from, err = parse("from", to.Add(-defaultStatsRange)); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	from = from.UTC().Truncate(time.Hour)
+	if rounded := to.UTC().Truncate(time.Hour); rounded.Before(to) {
+		to = rounded.Add(time.Hour)
+	} else {
+		to = rounded
+	}
+	switch {
+	case !from.Before(to):
+		return time.Time{}, time.Time{}, errors.New("from must be before to")
+	case to.Sub(from) > maxStatsRange:
+		return time.Time{}, time.Time{}, errors.Errorf("the range may not exceed %d days", int(maxStatsRange/(24*time.Hour)))
+	}
+	return from, to, nil
+}
+
+// writeStatsCSV writes ls as CSV, one `kind,key,clicks` row per value
+//  * the kinds are `total`, `unique_visitors`, `hour`, `day`, `referrer` and `agent`
+func writeStatsCSV(w http.ResponseWriter, ls LinkStats) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	cw := csv.NewWriter(w)
+	row := func(kind, key string, clicks int64) {
+		cw.Write([]string{kind, key, strconv.FormatInt(clicks, 10)})
+	}
+	cw.Write([]string{"kind", "key", "clicks"})
+	row("total", "", ls.Total)
+	row("unique_visitors", "", ls.UniqueVisitors)
+	for _, b := range ls.Hourly {
+		row("hour", b.Start.Format(time.RFC3339), b.Clicks)
+	}
+	for _, b := range ls.Daily {
+		row("day", b.Start.Format("2006-01-02"), b.Clicks)
+	}
+	for _, c := range ls.TopReferrers {
+		row("referrer", c.Value, c.Clicks)
+	}
+	for _, c := range ls.TopAgents {
+		row("agent", c.Value, c.Clicks)
+	}
+	cw.Flush()
+}
@@ -0,0 +1,161 @@
+package goUrlShortener
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryRollupsCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	clicksFile := filepath.Join(dir, "clicks.jsonl")
+	checkpoint := clicksFile + ".rollups"
+	sink := NewFileClickSink(clicksFile)
+	now := time.Now().UTC().Truncate(time.Hour)
+	click := func(path string) ClickEvent {
+		return ClickEvent{Path: path, Time: now, IP: "192.0.2.0", Destination: "https://example.com"}
+	}
+	total := func(m *MemoryRollups, path string) int64 {
+		ls, err := m.LinkStats("", path, now, now.Add(time.Hour), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ls.Total
+	}
+
+	rollups, err := LoadMemoryRollups(checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.WriteClicks([]ClickEvent{click("/a"), click("/a"), click("/b")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewAggregator(sink, rollups, 2).AggregateOnce(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restart resumes from the checkpoint, and only rolls up the clicks written since
+	if err = sink.WriteClicks([]ClickEvent{click("/b")}); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := LoadMemoryRollups(checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewAggregator(sink, restarted, 2).AggregateOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || total(restarted, "/a") != 2 || total(restarted, "/b") != 2 {
+		t.Errorf("after a restart, rolled up %d clicks, /a has %d and /b %d, want 1, 2 and 2", n, total(restarted, "/a"), total(restarted, "/b"))
+	}
+
+	// a clicks file replaced under the checkpoint is reported, rather than never read again
+	if err = ioutil.WriteFile(clicksFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewAggregator(sink, restarted, 2).AggregateOnce(); err == nil {
+		t.Errorf("AggregateOnce of a truncated clicks file succeeded, want an error")
+	}
+
+	if err = ioutil.WriteFile(checkpoint, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadMemoryRollups(checkpoint); err == nil {
+		t.Errorf("LoadMemoryRollups of a broken checkpoint succeeded, want an error")
+	}
+	os.Remove(checkpoint)
+	if _, err = LoadMemoryRollups(checkpoint); err != nil {
+		t.Errorf("LoadMemoryRollups without a checkpoint = %v, want an empty MemoryRollups", err)
+	}
+}
+
+func TestMemoryRollupsExpireVisitors(t *testing.T) {
+	today := truncateDay(time.Now())
+	tests := []struct {
+		age      time.Duration
+		visitors int64
+	}{
+		{0, 1},
+		{visitorRetention - 24*time.Hour, 1},
+		{visitorRetention + 24*time.Hour, 0},
+	}
+	for _, tt := range tests {
+		day := today.Add(-tt.age)
+		rollups := NewMemoryRollups()
+		ev := ClickEvent{Path: "/a", Time: day.Add(time.Hour), IP: "192.0.2.0"}
+		if err := rollups.ApplyRollup(NewClickRollup([]ClickEvent{ev}), 0, 1); err != nil {
+			t.Fatal(err)
+		}
+		ls, err := rollups.LinkStats("", "/a", day, day.Add(24*time.Hour), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ls.Total != 1 || ls.UniqueVisitors != tt.visitors {
+			t.Errorf("a click %v ago = %d clicks and %d visitors, want 1 and %d", tt.age, ls.Total, ls.UniqueVisitors, tt.visitors)
+		}
+	}
+}
+
+func TestStatsRange(t *testing.T) {
+	now := time.Date(2026, 5, 8, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		query    string
+		from, to string // RFC 3339, or the start of the error
+	}{
+		{"", "2026-05-01T10:00:00Z", "2026-05-08T11:00:00Z"},
+		{"from=2026-05-01&to=2026-05-03", "2026-05-01T00:00:00Z", "2026-05-03T00:00:00Z"},
+		{"from=2026-05-01T08:15:00%2B02:00&to=2026-05-01T09:00:00Z", "2026-05-01T06:00:00Z", "2026-05-01T09:00:00Z"},
+		{"to=2026-05-03", "2026-04-26T00:00:00Z", "2026-05-03T00:00:00Z"},
+		{"from=2026-05-03&to=2026-05-03", "from must be before to", ""},
+		{"from=2026-01-01&to=2026-05-03", "the range may not exceed 92 days", ""},
+		{"from=yesterday", "from must be an RFC 3339 timestamp", ""},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		from, to, err := statsRange(query, now)
+		if err != nil {
+			if tt.to != "" || !strings.HasPrefix(err.Error(), tt.from) {
+				t.Errorf("statsRange(%s) failed: %v", tt.query, err)
+			}
+			continue
+		}
+		if from.Format(time.RFC3339) != tt.from || to.Format(time.RFC3339) != tt.to {
+			t.Errorf("statsRange(%s) = %s, %s, want %s, %s", tt.query, from.Format(time.RFC3339), to.Format(time.RFC3339), tt.from, tt.to)
+		}
+	}
+}
+
+func TestBuildLinkStats(t *testing.T) {
+	from := time.Date(2026, 5, 1, 22, 0, 0, 0, time.UTC)
+	to := from.Add(4 * time.Hour)
+	hourly := map[int64]int64{
+		from.Add(-time.Hour).Unix():    7, // outside the range
+		from.Unix():                    1,
+		from.Add(time.Hour).Unix():     2,
+		from.Add(3 * time.Hour).Unix(): 4,
+	}
+	ls := buildLinkStats("", "/promo", from, to, hourly, 3, nil, nil)
+
+	var gotHourly, gotDaily []int64
+	for _, b := range ls.Hourly {
+		gotHourly = append(gotHourly, b.Clicks)
+	}
+	for _, b := range ls.Daily {
+		gotDaily = append(gotDaily, b.Clicks)
+	}
+	if ls.Total != 7 || fmt.Sprint(gotHourly) != "[1 2 0 4]" || fmt.Sprint(gotDaily) != "[3 4]" {
+		t.Errorf("buildLinkStats = total %d, hourly %v, daily %v, want 7, [1 2 0 4], [3 4]", ls.Total, gotHourly, gotDaily)
+	}
+	if !ls.Daily[1].Start.Equal(time.Date(2026, 5, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("the second daily bucket starts at %s, want 2026-05-02", ls.Daily[1].Start)
+	}
+	if ls.UniqueVisitors != 3 {
+		t.Errorf("UniqueVisitors = %d, want 3", ls.UniqueVisitors)
+	}
+}
@@ -0,0 +1,182 @@
+package goUrlShortener
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned by a Store when the requested path has no mapping
+var ErrNotFound = errors.New("path not found")
+
+// Store defines the backend that holds the path to URL mappings served by StoreHandler
+//  * mappings are addressed by the key HostKey builds from their host and path, which is the bare path for catch-all mappings
+//  * Lookup returns the mapping for a key, with `ok` set to false when the key does not exist
+//  * Put creates or replaces the mapping for the key of pu
+//  * Delete removes the mapping for a key, returning ErrNotFound when the key does not exist
+//  * List returns every mapping held by the store
+type Store interface {
+	Lookup(key string) (pu PathURL, ok bool, err error)
+	Put(pu PathURL) error
+	Delete(key string) error
+	List() ([]PathURL, error)
+}
+
+// ListFilter selects the mappings listed by a Pager
+//  * Host keeps the mappings scoped to that host, or the catch-all mappings when it is empty, but only when ByHost is set
+//  * Prefix keeps the mappings whose path starts with it
+//  * Contains keeps the mappings whose path or url contains it
+//  * Exclude leaves out the mappings stored under those keys
+type ListFilter struct {
+	Host     string
+	ByHost   bool
+	Prefix   string
+	Contains string
+	Exclude  []string
+}
+
+// matches reports whether the filter keeps pu
+func (f ListFilter) matches(pu PathURL) bool {
+	switch {
+	case f.ByHost && !strings.EqualFold(pu.Host, f.Host):
+		return false
+	case !strings.HasPrefix(pu.Path, f.Prefix):
+		return false
+	case f.Contains != "" && !strings.Contains(pu.Path, f.Contains) && !strings.Contains(pu.URL, f.Contains):
+		return false
+	}
+	return !containsString(f.Exclude, pu.key())
+}
+
+// Pager is implemented by Stores that can list a page of their mappings without reading every mapping
+//  * ListPage returns the mappings that filter keeps, sorted by host then path, skipping the first offset and returning at most limit
+//  * total is how many mappings the filter keeps, across every page, when count is set
+//  * without count, a Pager may leave total at -1 rather than count every mapping the filter keeps
+type Pager interface {
+	ListPage(filter ListFilter, offset, limit int, count bool) (pathUrls []PathURL, total int, err error)
+}
+
+// listPage cuts the page of a Pager out of pathUrls, for the Stores that can only List every mapping
+//  * the total is always counted, since every mapping was read anyway
+func listPage(pathUrls []PathURL, filter ListFilter, offset, limit int) ([]PathURL, int) {
+	matched := make([]PathURL, 0, len(pathUrls))
+	for _, pu := range pathUrls {
+		if filter.matches(pu) {
+			matched = append(matched, pu)
+		}
+	}
+	sortPathUrls(matched)
+	if offset >= len(matched) {
+		return []PathURL{}, len(matched)
+	}
+	end := offset + limit
+	if end > len(matched) {
+		end = len(matched)
+	}
+	return matched[offset:end], len(matched)
+}
+
+// MemoryStore is an in-memory Store that is safe for concurrent use
+//  * it also implements PatternLister, keeping its pattern rules in precedence order
+type MemoryStore struct {
+	mu          sync.RWMutex
+	pathsToUrls map[string]PathURL
+	patterns    []PathURL
+}
+
+// NewMemoryStore returns a MemoryStore pre-filled with the provided mappings
+//  * later duplicates of the same `Host` and `Path` win, exactly as with buildPathsMap
+func NewMemoryStore(pathUrls []PathURL) *MemoryStore {
+	pathsToUrls := buildPathsMap(pathUrls)
+	return &MemoryStore{pathsToUrls: pathsToUrls, patterns: buildPatterns(pathsToUrls)}
+}
+
+// Lookup returns the mapping stored for key
+func (m *MemoryStore) Lookup(key string) (PathURL, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	pu, ok := m.pathsToUrls[key]
+	return pu, ok, nil
+}
+
+// Put creates or replaces the mapping for the key of pu
+func (m *MemoryStore) Put(pu PathURL) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pathsToUrls[pu.key()] = pu
+	if isPatternRule(pu.Path) {
+		m.patterns = buildPatterns(m.pathsToUrls)
+	}
+	return nil
+}
+
+// Delete removes the mapping for key
+func (m *MemoryStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.pathsToUrls[key]; !ok {
+		return ErrNotFound
+	}
+	delete(m.pathsToUrls, key)
+	if isPatternRule(key) {
+		m.patterns = buildPatterns(m.pathsToUrls)
+	}
+	return nil
+}
+
+// List returns every mapping, sorted by host then path so that the output is stable
+func (m *MemoryStore) List() ([]PathURL, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	pathUrls := make([]PathURL, 0, len(m.pathsToUrls))
+	for _, pu := range m.pathsToUrls {
+		pathUrls = append(pathUrls, pu)
+	}
+	sortPathUrls(pathUrls)
+	return pathUrls, nil
+}
+
+// Replace swaps every mapping held by the store for the provided ones in a single step
+//  * concurrent readers see either the old or the new mappings, never a mix of both
+func (m *MemoryStore) Replace(pathUrls []PathURL) {
+	pathsToUrls := buildPathsMap(pathUrls) // build outside the lock to keep readers unblocked
+	patterns := buildPatterns(pathsToUrls)
+	m.mu.Lock()
+	m.pathsToUrls, m.patterns = pathsToUrls, patterns
+	m.mu.Unlock()
+}
+
+// Patterns returns the pattern rules, in precedence order
+func (m *MemoryStore) Patterns() ([]PathURL, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.patterns, nil // never modified in place, so safe to share
+}
+
+// sortPathUrls sorts mappings by host then path i.e. the catch-all mappings by path, then the host-scoped ones
+func sortPathUrls(pathUrls []PathURL) {
+	sort.Slice(pathUrls, func(i, j int) bool { return lessPathURL(pathUrls[i], pathUrls[j]) })
+}
+
+// lessPathURL orders mappings by lowercase host, then path, byte by byte
+//  * the order of a `(host collate "C", path collate "C")` index, so that the `paths` table can be paged in it
+func lessPathURL(a, b PathURL) bool {
+	if ah, bh := strings.ToLower(a.Host), strings.ToLower(b.Host); ah != bh {
+		return ah < bh
+	}
+	return a.Path < b.Path
+}
+
+// buildPatterns picks the pattern rules out of pathsToUrls, in precedence order
+func buildPatterns(pathsToUrls map[string]PathURL) []PathURL {
+	var patterns []PathURL
+	for _, pu := range pathsToUrls {
+		if isPatternRule(pu.Path) {
+			patterns = append(patterns, pu)
+		}
+	}
+	sortPatterns(patterns)
+	return patterns
+}
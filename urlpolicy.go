@@ -0,0 +1,138 @@
+package goUrlShortener
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// URLPolicy decides which destinations a mapping may redirect to
+//  * Schemes lists the allowed schemes, `http` and `https` when empty
+//  * AllowDomains, when not empty, lists the only domains a destination may point at
+//  * DenyDomains lists domains a destination may never point at, even when they are allowed
+//  * a domain covers its subdomains, so `example.com` also covers `www.example.com`
+//  * SkipInvalid makes mapping files and the `paths` table skip, and log, a mapping with a disallowed destination
+//  * instead of refusing the whole source, the links API always refuses one
+//  * each source, the links API and Validate are given their URLPolicy, the zero URLPolicy allows any `http` or `https` destination
+type URLPolicy struct {
+	Schemes      []string
+	AllowDomains []string
+	DenyDomains  []string
+	SkipInvalid  bool
+}
+
+// InvalidURLError is returned when a destination breaks the URLPolicy
+type InvalidURLError struct {
+	URL    string
+	Reason string
+}
+
+// Error describes the destination and the rule it breaks
+func (e *InvalidURLError) Error() string {
+	return fmt.Sprintf("invalid url %q: %s", e.URL, e.Reason)
+}
+
+// CheckURL rejects a destination that breaks the policy with an *InvalidURLError
+//  * the destination must be an absolute URL with an allowed scheme, and an `http` or `https` destination must name a host
+func (p URLPolicy) CheckURL(dest string) error {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return &InvalidURLError{URL: dest, Reason: "it does not parse"}
+	}
+	if !u.IsAbs() {
+		return &InvalidURLError{URL: dest, Reason: "it must be absolute, with a scheme"}
+	}
+	scheme := strings.ToLower(u.Scheme)
+	schemes := p.Schemes
+	if len(schemes) == 0 {
+		schemes = []string{"http", "https"}
+	}
+	if !containsFold(schemes, scheme) {
+		return &InvalidURLError{URL: dest, Reason: fmt.Sprintf("scheme %q is not allowed, use %s", scheme, strings.Join(schemes, ", "))}
+	}
+	host := strings.ToLower(u.Hostname())
+	if (scheme == "http" || scheme == "https") && host == "" {
+		return &InvalidURLError{URL: dest, Reason: "it must name a host"}
+	}
+	if host == "" {
+		return nil // e.g. a `mailto:` destination, when that scheme is allowed
+	}
+	if domain, ok := matchDomain(p.DenyDomains, host); ok {
+		return &InvalidURLError{URL: dest, Reason: fmt.Sprintf("domain %s is denied", domain)}
+	}
+	if _, ok := matchDomain(p.AllowDomains, host); len(p.AllowDomains) > 0 && !ok {
+		return &InvalidURLError{URL: dest, Reason: fmt.Sprintf("host %s is not in an allowed domain", host)}
+	}
+	return nil
+}
+
+// checkURLTemplate checks the URL of a mapping, which may hold a `*` or `{name}` placeholders when the mapping is a rule
+//  * placeholders are only allowed after the host, so the scheme and host that policy checks are those of every destination
+//  * every placeholder is then replaced by a plain value, so what is checked is the shape every destination will have
+func checkURLTemplate(dest string, policy URLPolicy) error {
+	if origin := urlOrigin(dest); strings.Contains(origin, "*") || placeholderPattern.MatchString(origin) {
+		return &InvalidURLError{URL: dest, Reason: "a placeholder is only allowed in the path, query or fragment"}
+	}
+	sample := strings.Replace(placeholderPattern.ReplaceAllString(dest, "x"), "*", "x", -1)
+	err := policy.CheckURL(sample)
+	if e, ok := err.(*InvalidURLError); ok {
+		e.URL = dest
+	}
+	return err
+}
+
+// urlOrigin returns the scheme, user info, host and port of dest as written e.g. `https://user@host:8080` for `https://user@host:8080/a?b`
+//  * only the scheme of an opaque url e.g. `mailto:`, since it has no host
+func urlOrigin(dest string) string {
+	i := strings.Index(dest, "://")
+	if i < 0 {
+		return dest[:strings.Index(dest, ":")+1]
+	}
+	if end := strings.IndexAny(dest[i+len("://"):], "/?#"); end >= 0 {
+		return dest[:i+len("://")+end]
+	}
+	return dest
+}
+
+// matchDomain returns the first of domains that host is, or is a subdomain of
+func matchDomain(domains []string, host string) (string, bool) {
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return domain, true
+		}
+	}
+	return "", false
+}
+
+// containsFold reports whether values holds value, ignoring case
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterPathUrls checks every mapping of a source, naming the offending mapping with locate(i) e.g. its line in the file
+//  * a mapping with a disallowed destination is skipped and logged when policy says so
+//  * any other invalid mapping rejects the whole source
+func FilterPathUrls(pathUrls []PathURL, policy URLPolicy, locate func(i int) string) ([]PathURL, error) {
+	valid := pathUrls[:0:0]
+	for i, pu := range pathUrls {
+		err := checkPathURL(pu, policy)
+		if _, invalidURL := errors.Cause(err).(*InvalidURLError); invalidURL && policy.SkipInvalid {
+			log.Printf("Skipping %s: path %s: %v", locate(i), pu.key(), err)
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: path %s", locate(i), pu.key())
+		}
+		valid = append(valid, pu)
+	}
+	return valid, nil
+}
@@ -0,0 +1,71 @@
+package goUrlShortener
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckURL(t *testing.T) {
+	policy := URLPolicy{AllowDomains: []string{"example.com", ".example.org"}, DenyDomains: []string{"bad.example.com"}}
+	tests := []struct {
+		policy URLPolicy
+		dest   string
+		reason string // the start of the reason, empty when allowed
+	}{
+		{URLPolicy{}, "https://anything.test/a", ""},
+		{URLPolicy{}, "HTTP://anything.test", ""},
+		{URLPolicy{}, "/relative", "it must be absolute"},
+		{URLPolicy{}, "javascript:alert(1)", `scheme "javascript" is not allowed`},
+		{URLPolicy{}, "https:///no-host", "it must name a host"},
+		{URLPolicy{}, "https://%zz", "it does not parse"},
+		{URLPolicy{Schemes: []string{"https", "mailto"}}, "mailto:team@example.com", ""},
+		{URLPolicy{Schemes: []string{"https", "mailto"}}, "http://example.com", `scheme "http" is not allowed, use https, mailto`},
+		{policy, "https://example.com/a", ""},
+		{policy, "https://www.EXAMPLE.com/a", ""},
+		{policy, "https://docs.example.org", ""},
+		{policy, "https://notexample.com", "host notexample.com is not in an allowed domain"},
+		{policy, "https://bad.example.com", "domain bad.example.com is denied"},
+		{policy, "https://deeper.bad.example.com", "domain bad.example.com is denied"},
+	}
+	for _, tt := range tests {
+		err := tt.policy.CheckURL(tt.dest)
+		if tt.reason == "" {
+			if err != nil {
+				t.Errorf("CheckURL(%q) = %v, want it allowed", tt.dest, err)
+			}
+			continue
+		}
+		e, ok := err.(*InvalidURLError)
+		if !ok || e.URL != tt.dest || !strings.HasPrefix(e.Reason, tt.reason) {
+			t.Errorf("CheckURL(%q) = %v, want an *InvalidURLError because %s", tt.dest, err, tt.reason)
+		}
+	}
+}
+
+func TestCheckURLTemplate(t *testing.T) {
+	policy := URLPolicy{AllowDomains: []string{"example.com"}}
+	tests := []struct {
+		dest   string
+		reason string
+	}{
+		{"https://example.com/docs/*", ""},
+		{"https://example.com/{name}?ref={ref}#{section}", ""},
+		{"https://{host}/docs", "a placeholder is only allowed in the path, query or fragment"},
+		{"https://*.example.com/docs", "a placeholder is only allowed in the path, query or fragment"},
+		{"{scheme}://example.com", "a placeholder is only allowed in the path, query or fragment"},
+		{"https://other.test/{name}", "host other.test is not in an allowed domain"},
+	}
+	for _, tt := range tests {
+		err := checkURLTemplate(tt.dest, policy)
+		if tt.reason == "" {
+			if err != nil {
+				t.Errorf("checkURLTemplate(%q) = %v, want it allowed", tt.dest, err)
+			}
+			continue
+		}
+		e, ok := err.(*InvalidURLError)
+		if !ok || e.URL != tt.dest || !strings.HasPrefix(e.Reason, tt.reason) {
+			t.Errorf("checkURLTemplate(%q) = %v, want an *InvalidURLError for the template because %s", tt.dest, err, tt.reason)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package goUrlShortener
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxRedirectHops bounds how far Validate follows destinations that point back at the server
+const maxRedirectHops = 32
+
+// SourceMapping is a mapping together with the place it was read from e.g. `links.yaml line 12`
+type SourceMapping struct {
+	PathURL
+	Location string
+}
+
+// Locator is implemented by Stores that can say where each of their mappings was read from
+//  * Locate returns the mappings as written, including those that fail their checks
+type Locator interface {
+	Locate() ([]SourceMapping, error)
+}
+
+// Problem is one finding of Validate, for the mapping stored under Key
+//  * Locations names every place involved e.g. both copies of a duplicate
+type Problem struct {
+	Key       string
+	Message   string
+	Locations []string
+}
+
+// String describes the problem along with its locations
+func (p Problem) String() string {
+	return fmt.Sprintf("path %s: %s (%s)", p.Key, p.Message, strings.Join(p.Locations, " and "))
+}
+
+// ValidateOptions declares what the mappings are validated against
+//  * Reserved lists the paths the server answers itself e.g. `/` or `/healthz`, which a mapping collides with
+//  * Hosts lists the hosts the server answers on, besides those of host-scoped mappings
+//  * a destination on one of those hosts is followed, to find redirect cycles
+//  * URLPolicy is the policy the sources check their urls against
+type ValidateOptions struct {
+	Reserved  []string
+	Hosts     []string
+	URLPolicy URLPolicy
+}
+
+// Validate reads every layer of store as written, and reports
+//  * mappings that fail their checks, which a source refuses or skips when it is loaded
+//  * catch-all paths that do not start with `/`, which no request ever matches
+//  * duplicates of the same host and path, within a layer or across layers, naming both locations
+//  * paths that differ only by a trailing slash
+//  * mappings that collide with a reserved path
+//  * redirect cycles, where following destinations on our own hosts comes back to the same mapping
+//  * layers that implement Locator name each mapping's location, other layers are named after the layer
+func Validate(store *LayeredStore, opts ValidateOptions) ([]Problem, error) {
+	var problems []Problem
+	report := func(key, message string, locations ...string) {
+		problems = append(problems, Problem{Key: key, Message: message, Locations: locations})
+	}
+
+	first := make(map[string]SourceMapping) // the location that wins for each key, for reporting duplicates
+	layers := make([]Layer, 0, len(store.Layers()))
+	hosts := make(map[string]bool)
+	for _, h := range opts.Hosts {
+		hosts[strings.ToLower(h)] = true
+	}
+	for _, l := range store.Layers() {
+		mappings, err := locate(l)
+		if err != nil {
+			return nil, errors.Wrapf(err, "layer %s", l.Name)
+		}
+
+		inLayer := make(map[string]SourceMapping)
+		var valid []PathURL
+		for _, sm := range mappings {
+			key := sm.key()
+			if err := checkPathURL(sm.PathURL, opts.URLPolicy); err != nil {
+				report(key, err.Error(), sm.Location)
+				continue
+			}
+			if sm.Host == "" && sm.Path != "" && !strings.HasPrefix(sm.Path, "/") {
+				report(key, "the path does not start with `/`, so no request ever matches it", sm.Location)
+			}
+			if prev, ok := inLayer[key]; ok {
+				report(key, "duplicate, the later mapping wins", prev.Location, sm.Location)
+			} else if prev, ok := first[key]; ok {
+				report(key, "duplicate, shadowed by the earlier source", prev.Location, sm.Location)
+			}
+			inLayer[key] = sm
+			if sm.Host != "" {
+				hosts[strings.ToLower(sm.Host)] = true
+			}
+			valid = append(valid, sm.PathURL)
+		}
+		for key, sm := range inLayer {
+			if _, ok := first[key]; !ok {
+				first[key] = sm
+			}
+		}
+		layers = append(layers, Layer{Name: l.Name, Store: NewMemoryStore(valid)})
+	}
+
+	for key, sm := range first {
+		if isPrefixRule(sm.Path) || !strings.HasSuffix(sm.Path, "/") || sm.Path == "/" {
+			continue
+		}
+		if other, ok := first[strings.TrimSuffix(key, "/")]; ok {
+			report(other.key(), "differs from "+key+" only by a trailing slash", other.Location, sm.Location)
+		}
+	}
+
+	resolved := NewLayeredStore(layers...)
+	if err := checkReserved(resolved, first, hosts, opts.Reserved, report); err != nil {
+		return nil, err
+	}
+	if err := checkCycles(resolved, first, hosts, report); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Key < problems[j].Key })
+	return problems, nil
+}
+
+// locate returns the mappings of a layer, along with where each was read from
+func locate(l Layer) ([]SourceMapping, error) {
+	if locator, ok := l.Store.(Locator); ok {
+		return locator.Locate()
+	}
+	pathUrls, err := l.Store.List()
+	if err != nil {
+		return nil, err
+	}
+	mappings := make([]SourceMapping, len(pathUrls))
+	for i, pu := range pathUrls {
+		mappings[i] = SourceMapping{PathURL: pu, Location: l.Name}
+	}
+	return mappings, nil
+}
+
+// checkReserved reports the mappings that a request for a reserved path would be redirected by, on any of our hosts
+func checkReserved(store Store, first map[string]SourceMapping, hosts map[string]bool, reserved []string, report func(key, message string, locations ...string)) error {
+	reported := make(map[string]bool)
+	for _, path := range reserved {
+		for _, host := range append([]string{""}, sortedHosts(hosts)...) {
+			pu, _, ok, err := Match(store, host, path)
+			if err != nil {
+				return err
+			}
+			if !ok || reported[pu.key()+" "+path] {
+				continue
+			}
+			reported[pu.key()+" "+path] = true
+			report(pu.key(), "collides with the reserved path "+path, first[pu.key()].Location)
+		}
+	}
+	return nil
+}
+
+// checkCycles follows the destination of every mapping while it points at one of our hosts, and reports the cycles found
+//  * a rule's destination depends on the request, so it is only followed when it has no placeholder
+//  * each cycle is reported once, for its lowest key
+func checkCycles(store Store, first map[string]SourceMapping, hosts map[string]bool, report func(key, message string, locations ...string)) error {
+	keys := make([]string, 0, len(first))
+	for key := range first {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, start := range keys {
+		pu := first[start].PathURL
+		hops := []string{start}
+		for len(hops) <= maxRedirectHops {
+			next, ok, err := followDestination(store, pu, hosts)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			if next.key() == start {
+				locations := make([]string, len(hops))
+				for i, key := range hops {
+					locations[i] = first[key].Location
+				}
+				report(start, "redirect cycle "+strings.Join(append(hops, start), " -> "), locations...)
+				break
+			}
+			if next.key() < start || containsString(hops, next.key()) { // found from the cycle's lowest key, or a cycle start is not part of
+				break
+			}
+			hops = append(hops, next.key())
+			pu = next
+		}
+	}
+	return nil
+}
+
+// followDestination returns the mapping that the destination of pu is redirected by, when it points at one of our hosts
+func followDestination(store Store, pu PathURL, hosts map[string]bool) (PathURL, bool, error) {
+	if strings.Contains(pu.URL, "*") || placeholderPattern.MatchString(pu.URL) {
+		return PathURL{}, false, nil
+	}
+	u, err := url.Parse(pu.URL)
+	if err != nil || u.Host == "" {
+		return PathURL{}, false, nil
+	}
+	host := strings.ToLower(u.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !hosts[host] {
+		return PathURL{}, false, nil
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	next, _, ok, err := Match(store, host, path)
+	return next, ok, err
+}
+
+// sortedHosts returns the hosts of a set in order, so that reports are stable
+func sortedHosts(hosts map[string]bool) []string {
+	sorted := make([]string, 0, len(hosts))
+	for host := range hosts {
+		sorted = append(sorted, host)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// containsString reports whether list holds s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package goUrlShortener
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// memoryLayers returns a layer over a MemoryStore for each named list of mappings, in order
+func memoryLayers(names []string, mappings ...[]PathURL) []Layer {
+	layers := make([]Layer, len(names))
+	for i, name := range names {
+		layers[i] = Layer{Name: name, Store: NewMemoryStore(mappings[i])}
+	}
+	return layers
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		layers []Layer
+		opts   ValidateOptions
+		want   []string
+	}{
+		{
+			name:   "clean",
+			layers: memoryLayers([]string{"file"}, []PathURL{{Path: "/a", URL: "https://example.com/a"}, {Path: "/b/*", URL: "https://example.com/b/*"}}),
+			opts:   ValidateOptions{Reserved: []string{"/healthz"}},
+		},
+		{
+			name:   "invalid mapping",
+			layers: memoryLayers([]string{"file"}, []PathURL{{Path: "/a", URL: "https://example.com/a", Status: 200}}),
+			want:   []string{"path /a: invalid redirect status 200, use 301, 302, 303, 307 or 308 (file)"},
+		},
+		{
+			name:   "catch-all path without a leading slash",
+			layers: memoryLayers([]string{"file"}, []PathURL{{Path: "a", URL: "https://example.com/a"}}),
+			want:   []string{"path a: the path does not start with `/`, so no request ever matches it (file)"},
+		},
+		{
+			name:   "duplicate across layers",
+			layers: memoryLayers([]string{"file", "sql"}, []PathURL{{Path: "/a", URL: "https://example.com/1"}}, []PathURL{{Path: "/a", URL: "https://example.com/2"}}),
+			want:   []string{"path /a: duplicate, shadowed by the earlier source (file and sql)"},
+		},
+		{
+			name:   "host-scoped mappings are distinct from catch-all ones",
+			layers: memoryLayers([]string{"file", "sql"}, []PathURL{{Path: "/a", URL: "https://example.com/1"}}, []PathURL{{Host: "go", Path: "/a", URL: "https://example.com/2"}}),
+		},
+		{
+			name:   "trailing-slash twin",
+			layers: memoryLayers([]string{"file", "sql"}, []PathURL{{Path: "/a", URL: "https://example.com/1"}}, []PathURL{{Path: "/a/", URL: "https://example.com/2"}}),
+			want:   []string{"path /a: differs from /a/ only by a trailing slash (file and sql)"},
+		},
+		{
+			name:   "reserved path",
+			layers: memoryLayers([]string{"file"}, []PathURL{{Path: "/healthz", URL: "https://example.com/h"}, {Path: "/*", URL: "https://example.com/*"}}),
+			opts:   ValidateOptions{Reserved: []string{"/", "/healthz", "/api/links"}},
+			want: []string{
+				"path /*: collides with the reserved path / (file)",
+				"path /*: collides with the reserved path /api/links (file)",
+				"path /healthz: collides with the reserved path /healthz (file)",
+			},
+		},
+		{
+			name: "redirect cycle through our hosts",
+			layers: memoryLayers([]string{"file", "sql"},
+				[]PathURL{{Path: "/a", URL: "https://go.example.com/b"}, {Path: "/c", URL: "https://go.example.com/d"}},
+				[]PathURL{{Path: "/b", URL: "https://GO.example.com:8080/a"}, {Path: "/d", URL: "https://example.com/d"}}),
+			opts: ValidateOptions{Hosts: []string{"go.example.com"}},
+			want: []string{"path /a: redirect cycle /a -> /b -> /a (file and sql)"},
+		},
+		{
+			name:   "destinations on other hosts are not followed",
+			layers: memoryLayers([]string{"file"}, []PathURL{{Path: "/a", URL: "https://go.example.com/a"}}),
+		},
+		{
+			name:   "a host-scoped mapping makes its host ours",
+			layers: memoryLayers([]string{"file"}, []PathURL{{Host: "go", Path: "/a", URL: "http://go/a"}}),
+			want:   []string{"path go/a: redirect cycle go/a -> go/a (file)"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			problems, err := Validate(NewLayeredStore(test.layers...), test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, p := range problems {
+				got = append(got, p.String())
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Validate() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateDuplicateWithinLayer(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "links.yaml")
+	if err := ioutil.WriteFile(filename, []byte("- path: /a\n  url: https://example.com/1\n- path: /a\n  url: https://example.com/2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewYAMLStore(filename, URLPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems, err := Validate(NewLayeredStore(Layer{Name: "file", Store: fs}), ValidateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Problem{{Key: "/a", Message: "duplicate, the later mapping wins", Locations: []string{filename + " line 1", filename + " line 3"}}}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("Validate() = %v, want %v", problems, want)
+	}
+}